@@ -6,6 +6,7 @@ import (
 	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
 )
 
 type ProducerParam struct {
@@ -114,3 +115,136 @@ func Consumer(param ConsumerParam) error {
 
 	return nil
 }
+
+type BroadcastParam struct {
+	ConnectionStr string
+	AppId         string
+	Exchange      string
+	Data          []byte
+}
+
+type SubscriberParam struct {
+	ConnectionStr string
+	Exchange      string
+	Handler       func(msg amqp.Delivery) error
+	// OnReconnect is called after the subscription was restored, broadcasts
+	// sent while disconnected are lost
+	OnReconnect func()
+	Logger      *logrus.Logger
+}
+
+// Broadcast publishes to every subscriber of a fanout exchange
+func Broadcast(param BroadcastParam) error {
+	conn, err := amqp.Dial(param.ConnectionStr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+	if err := channel.ExchangeDeclare(param.Exchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return channel.PublishWithContext(ctx, param.Exchange, "", false, false, amqp.Publishing{
+		AppId:       param.AppId,
+		ContentType: "application/json",
+		Body:        param.Data,
+	})
+}
+
+// Subscribe receives the broadcasts of a fanout exchange on a queue of its
+// own, so every instance gets every message, until the context is cancelled.
+// A lost connection is restored with an exponential backoff.
+func Subscribe(ctx context.Context, param SubscriberParam) error {
+	if param.Logger == nil {
+		param.Logger = logrus.StandardLogger()
+	}
+	conn, msgs, err := subscribe(param)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			receive(ctx, msgs, param.Handler)
+			conn.Close()
+			if ctx.Err() != nil {
+				return
+			}
+			param.Logger.Warn("Subscription to " + param.Exchange + " lost, reconnecting")
+
+			delay := time.Second
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+				if conn, msgs, err = subscribe(param); err == nil {
+					break
+				}
+				param.Logger.Error("Reconnecting to " + param.Exchange + " failed, because of " + err.Error())
+				if delay *= 2; delay > 30*time.Second {
+					delay = 30 * time.Second
+				}
+			}
+			param.Logger.Info("Subscription to " + param.Exchange + " restored")
+			if param.OnReconnect != nil {
+				param.OnReconnect()
+			}
+		}
+	}()
+	return nil
+}
+
+// subscribe binds a queue of its own to the exchange
+func subscribe(param SubscriberParam) (*amqp.Connection, <-chan amqp.Delivery, error) {
+	conn, err := amqp.Dial(param.ConnectionStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := channel.ExchangeDeclare(param.Exchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	queue, err := channel.QueueDeclare("", false, true, true, false, nil)
+	if err == nil {
+		err = channel.QueueBind(queue.Name, "", param.Exchange, false, nil)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	msgs, err := channel.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, msgs, nil
+}
+
+// receive handles messages until the connection is lost or the context is cancelled
+func receive(ctx context.Context, msgs <-chan amqp.Delivery, handler func(msg amqp.Delivery) error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			_ = handler(msg)
+		}
+	}
+}
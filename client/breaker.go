@@ -0,0 +1,85 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned while the circuit breaker of a host is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerConfig configures the circuit breaker of each host
+type BreakerConfig struct {
+	// Failures is the number of consecutive failures opening the circuit
+	Failures int
+	// OpenTimeout is how long the circuit stays open before probing the host
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of probe requests while half open
+	HalfOpenRequests int
+}
+
+type breakerState int
+
+const (
+	closed breakerState = iota
+	open
+	halfOpen
+)
+
+// breaker stops calls to a failing host until a probe succeeds
+type breaker struct {
+	config   BreakerConfig
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	probes   int
+	openedAt time.Time
+}
+
+// allow reports whether a call may be made
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case open:
+		if time.Since(b.openedAt) < b.config.OpenTimeout {
+			return false
+		}
+		b.state = halfOpen
+		b.probes = 0
+		fallthrough
+	case halfOpen:
+		if b.probes >= b.config.HalfOpenRequests {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of an allowed call
+func (b *breaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if success {
+		b.state = closed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == halfOpen || b.failures >= b.config.Failures {
+		b.state = open
+		b.openedAt = time.Now()
+	}
+}
+
+// abandon returns the probe of a call cancelled by the caller, whose outcome
+// says nothing about the host
+func (b *breaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == halfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
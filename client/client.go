@@ -0,0 +1,334 @@
+// Package client calls sibling services with retries, circuit breakers,
+// bulkheads and propagation of the request id, trace context and service token.
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/greatfocus/gf-sframe/server"
+)
+
+// ErrBulkheadFull is returned when a host has too many calls in flight
+var ErrBulkheadFull = errors.New("too many concurrent requests")
+
+// Config configures a client
+type Config struct {
+	// Timeout bounds each attempt, within the deadline of the request context
+	Timeout time.Duration
+	// MaxRetries is the number of retries of idempotent requests, negative
+	// values disable retries
+	MaxRetries int
+	// BaseDelay and MaxDelay bound the jittered exponential backoff
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// MaxRetryAfter bounds the delay a Retry-After header may ask for
+	MaxRetryAfter time.Duration
+	// MaxConcurrent bounds the calls in flight to each host
+	MaxConcurrent int
+	// BulkheadWait is how long a call waits for a slot of a full host, zero
+	// fails at once
+	BulkheadWait time.Duration
+	Breaker      BreakerConfig
+	// JWT mints a service token carrying Token for requests without an
+	// Authorization header, when set
+	JWT   server.JWT
+	Token server.TokenInfo
+	// Signer signs every attempt, when set
+	Signer    *Signer
+	Transport http.RoundTripper
+}
+
+// DefaultConfig retries idempotent requests three times and opens the circuit
+// of a host after five consecutive failures
+var DefaultConfig = Config{
+	Timeout:       10 * time.Second,
+	MaxRetries:    3,
+	BaseDelay:     100 * time.Millisecond,
+	MaxDelay:      2 * time.Second,
+	MaxRetryAfter: 30 * time.Second,
+	MaxConcurrent: 100,
+	Breaker: BreakerConfig{
+		Failures:         5,
+		OpenTimeout:      30 * time.Second,
+		HalfOpenRequests: 1,
+	},
+}
+
+// Client is a resilient http client for service to service calls
+type Client struct {
+	config Config
+	http   *http.Client
+	mu     sync.Mutex
+	hosts  map[string]*host
+}
+
+// host holds the breaker and bulkhead of a host
+type host struct {
+	breaker  *breaker
+	bulkhead chan struct{}
+}
+
+// New creates a client, zero fields take the default configuration
+func New(config Config) *Client {
+	defaults := DefaultConfig
+	if config.Timeout <= 0 {
+		config.Timeout = defaults.Timeout
+	}
+	switch {
+	case config.MaxRetries == 0:
+		config.MaxRetries = defaults.MaxRetries
+	case config.MaxRetries < 0:
+		config.MaxRetries = 0
+	}
+	if config.BaseDelay <= 0 {
+		config.BaseDelay = defaults.BaseDelay
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = defaults.MaxDelay
+	}
+	if config.MaxRetryAfter <= 0 {
+		config.MaxRetryAfter = defaults.MaxRetryAfter
+	}
+	if config.MaxConcurrent <= 0 {
+		config.MaxConcurrent = defaults.MaxConcurrent
+	}
+	if config.Breaker.Failures <= 0 {
+		config.Breaker.Failures = defaults.Breaker.Failures
+	}
+	if config.Breaker.OpenTimeout <= 0 {
+		config.Breaker.OpenTimeout = defaults.Breaker.OpenTimeout
+	}
+	if config.Breaker.HalfOpenRequests <= 0 {
+		config.Breaker.HalfOpenRequests = defaults.Breaker.HalfOpenRequests
+	}
+	transport := config.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Client{
+		config: config,
+		http:   &http.Client{Transport: transport},
+		hosts:  make(map[string]*host),
+	}
+}
+
+// Get calls url with the GET method
+func (c *Client) Get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+// Post calls url with the POST method, which is not retried
+func (c *Client) Post(ctx context.Context, url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.Do(req)
+}
+
+// Do sends the request. Idempotent requests, and requests carrying an
+// Idempotency-Key header, are retried on network errors and on 429, 502, 503
+// and 504 responses while the request context allows.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	req = req.Clone(ctx)
+	if err := c.propagate(req); err != nil {
+		return nil, err
+	}
+
+	h := c.host(req.URL.Host)
+	retries := 0
+	if isIdempotent(req) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil) {
+		retries = c.config.MaxRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		if c.config.Signer != nil {
+			if err := c.config.Signer.Sign(req); err != nil {
+				return nil, err
+			}
+		}
+
+		res, err := c.attempt(req, h)
+		if attempt >= retries || !retryable(ctx, res, err) {
+			return res, err
+		}
+
+		delay := c.backoff(attempt, res)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return res, err
+		}
+		if res != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+			_ = res.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt sends the request once through the breaker and bulkhead of the host
+func (c *Client) attempt(req *http.Request, h *host) (*http.Response, error) {
+	ctx := req.Context()
+	select {
+	case h.bulkhead <- struct{}{}:
+	default:
+		wait := time.NewTimer(c.config.BulkheadWait)
+		defer wait.Stop()
+		select {
+		case h.bulkhead <- struct{}{}:
+		case <-wait.C:
+			return nil, ErrBulkheadFull
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if !h.breaker.allow() {
+		<-h.bulkhead
+		return nil, ErrCircuitOpen
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	res, err := c.http.Do(req.WithContext(attemptCtx))
+	switch {
+	case err != nil && ctx.Err() != nil:
+		h.breaker.abandon()
+	case err != nil || res.StatusCode >= http.StatusInternalServerError:
+		h.breaker.record(false)
+	default:
+		h.breaker.record(true)
+	}
+	if err != nil {
+		cancel()
+		<-h.bulkhead
+		return nil, err
+	}
+
+	// the slot and attempt context are released once the body is closed
+	res.Body = &releaseBody{ReadCloser: res.Body, release: func() {
+		cancel()
+		<-h.bulkhead
+	}}
+	return res, nil
+}
+
+// propagate sets the request id, trace context and service token of the request
+func (c *Client) propagate(req *http.Request) error {
+	ctx := req.Context()
+	if requestID := server.RequestIDFromContext(ctx); requestID != "" && req.Header.Get(server.RequestIDHeader) == "" {
+		req.Header.Set(server.RequestIDHeader, requestID)
+	}
+	if req.Header.Get("traceparent") == "" {
+		trace, ok := server.TraceFromContext(ctx)
+		if !ok {
+			trace = server.NewTraceContext()
+		}
+		trace = trace.Child()
+		req.Header.Set("traceparent", trace.TraceParent())
+		if trace.State != "" {
+			req.Header.Set("tracestate", trace.State)
+		}
+	}
+	if c.config.JWT != nil && req.Header.Get("Authorization") == "" {
+		token, err := c.config.JWT.CreateToken(c.config.Token)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+func (c *Client) host(name string) *host {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, exists := c.hosts[name]
+	if !exists {
+		h = &host{
+			breaker:  &breaker{config: c.config.Breaker},
+			bulkhead: make(chan struct{}, c.config.MaxConcurrent),
+		}
+		c.hosts[name] = h
+	}
+	return h
+}
+
+// backoff returns a full jitter exponential delay, or the Retry-After of the
+// response when it is longer, up to MaxRetryAfter
+func (c *Client) backoff(attempt int, res *http.Response) time.Duration {
+	ceiling := math.Min(float64(c.config.MaxDelay), float64(c.config.BaseDelay)*math.Pow(2, float64(attempt)))
+	// jitter does not need a secure source
+	delay := time.Duration(rand.Int63n(int64(ceiling) + 1))
+	if res != nil {
+		if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter := c.config.MaxRetryAfter
+			if seconds < int(retryAfter/time.Second) {
+				retryAfter = time.Duration(seconds) * time.Second
+			}
+			if retryAfter > delay {
+				delay = retryAfter
+			}
+		}
+	}
+	return delay
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// retryable reports whether the attempt failed for a reason a retry may fix,
+// open circuits and full bulkheads are not retried to shed load
+func retryable(ctx context.Context, res *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil && !errors.Is(err, ErrCircuitOpen) && !errors.Is(err, ErrBulkheadFull)
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// releaseBody releases the attempt resources when the body is closed
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
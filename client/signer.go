@@ -0,0 +1,23 @@
+package client
+
+import (
+	"net/http"
+
+	"github.com/greatfocus/gf-sframe/server"
+)
+
+// Signer signs requests with HMAC-SHA256 for services verifying them with a
+// server.SignatureVerifier
+type Signer struct {
+	KeyID  string
+	Secret []byte
+	// Headers are signed next to the method, path, query and body digest,
+	// server.DefaultSignedHeaders when empty
+	Headers []string
+}
+
+// Sign sets the Content-Digest and Signature headers of the request, each
+// attempt is signed with a fresh nonce
+func (s *Signer) Sign(req *http.Request) error {
+	return server.SignRequest(req, s.KeyID, s.Secret, s.Headers...)
+}
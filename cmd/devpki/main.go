@@ -0,0 +1,29 @@
+// Command devpki writes development certificates and keys to an env file.
+//
+//	go run github.com/greatfocus/gf-sframe/cmd/devpki -out .env -hosts localhost,127.0.0.1
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/greatfocus/gf-sframe/server"
+)
+
+func main() {
+	out := flag.String("out", ".env", "env file to update")
+	hosts := flag.String("hosts", "localhost,127.0.0.1,::1", "comma separated server host names and addresses")
+	dbHost := flag.String("db-host", "localhost", "postgres server host name")
+	dbUser := flag.String("db-user", "postgres", "postgres user of the client certificate")
+	flag.Parse()
+
+	pki, err := server.GenerateDevPKI(strings.Split(*hosts, ","), *dbHost, *dbUser)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := pki.WriteEnv(*out); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Development key material written to " + *out)
+}
@@ -0,0 +1,328 @@
+package crypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// Files are encrypted with the STREAM construction: a random data key wrapped
+// by the master key is stored in the header, followed by fixed size chunks
+// sealed with AES-GCM under a nonce made of a random prefix, the chunk counter
+// and a flag marking the final chunk. Truncation, reordering and tampering of
+// chunks are detected, and any chunk can be decrypted on its own. Streams are
+// written once, a chunk is never sealed again under the same nonce.
+const (
+	// ChunkSize is the plaintext size of every chunk but the last
+	ChunkSize = 64 * 1024
+
+	streamMagic   = "GFE1"
+	prefixSize    = 7
+	tagSize       = 16
+	wrapNonceSize = 12
+	dataKeySize   = 32
+	headerSize    = len(streamMagic) + wrapNonceSize + dataKeySize + tagSize + prefixSize
+	sealedSize    = ChunkSize + tagSize
+)
+
+var (
+	// ErrInvalidStream is returned when encrypted content fails to authenticate
+	ErrInvalidStream = errors.New("invalid encrypted stream")
+	errWriterClosed  = errors.New("encrypt writer closed")
+)
+
+// NewEncryptWriter returns a writer encrypting everything written to w.
+// Close must be called to seal the final chunk.
+func NewEncryptWriter(w io.Writer, masterKey string) (io.WriteCloser, error) {
+	header, aead, err := newHeader(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+	}, nil
+}
+
+// IsEncrypted reports whether r starts with the header of an encrypted stream
+func IsEncrypted(r io.ReaderAt) bool {
+	magic := make([]byte, len(streamMagic))
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return false
+	}
+	return string(magic) == streamMagic
+}
+
+// NewDecryptReader returns a reader decrypting the content of r.
+// The reader also implements io.Seeker when r does, allowing range reads.
+func NewDecryptReader(r io.Reader, masterKey string) (io.ReadSeeker, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrInvalidStream
+	}
+	aead, err := openHeader(header, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decryptReader{
+		src:    r,
+		r:      bufio.NewReaderSize(r, sealedSize+1),
+		aead:   aead,
+		header: header,
+		size:   -1,
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := seeker.Seek(int64(headerSize), io.SeekStart); err != nil {
+			return nil, err
+		}
+		d.size = PlainSize(end)
+	}
+	return d, nil
+}
+
+// PlainSize returns the plaintext size of an encrypted file of the given size
+func PlainSize(cipherSize int64) int64 {
+	body := cipherSize - int64(headerSize)
+	if body < tagSize {
+		return 0
+	}
+	chunks := (body + sealedSize - 1) / sealedSize
+	return body - chunks*tagSize
+}
+
+// encryptWriter seals plaintext into chunks
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	counter uint32
+	closed  bool
+}
+
+// Write buffers plaintext and seals every complete chunk
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errWriterClosed
+	}
+	n := len(p)
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data proves it is not the last
+		if len(e.buf) == ChunkSize {
+			if err := e.seal(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		take := ChunkSize - len(e.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+		e.buf = append(e.buf, p[:take]...)
+		p = p[take:]
+	}
+	return n, nil
+}
+
+// Close seals the final chunk
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+// seal encrypts and writes the buffered chunk
+func (e *encryptWriter) seal(final bool) error {
+	if !final && e.counter == ^uint32(0) {
+		return errors.New("encrypted stream too large")
+	}
+	sealed := e.aead.Seal(nil, chunkNonce(e.header, e.counter, final), e.buf, e.header)
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.counter++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// decryptReader opens chunks as they are read
+type decryptReader struct {
+	src     io.Reader
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	counter uint32
+	plain   []byte
+	skip    int
+	done    bool
+	size    int64
+	pos     int64
+}
+
+// Read returns decrypted content
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	d.pos += int64(n)
+	return n, nil
+}
+
+// Seek moves to a plaintext position
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := d.src.(io.Seeker)
+	if !ok || d.size < 0 {
+		return 0, errors.New("encrypted stream is not seekable")
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	d.pos = offset
+	d.plain = nil
+	if offset >= d.size {
+		d.done = true
+		return offset, nil
+	}
+	d.counter = uint32(offset / ChunkSize)
+	d.skip = int(offset % ChunkSize)
+	d.done = false
+	if _, err := seeker.Seek(int64(headerSize)+int64(d.counter)*sealedSize, io.SeekStart); err != nil {
+		return 0, err
+	}
+	d.r.Reset(d.src)
+	return offset, nil
+}
+
+// next reads and opens the following chunk
+func (d *decryptReader) next() error {
+	sealed := make([]byte, sealedSize)
+	n, err := io.ReadFull(d.r, sealed)
+	final := false
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		final = true
+	case err != nil:
+		return err
+	default:
+		if _, err := d.r.Peek(1); err == io.EOF {
+			final = true
+		}
+	}
+
+	plain, err := d.aead.Open(sealed[:0], chunkNonce(d.header, d.counter, final), sealed[:n], d.header)
+	if err != nil {
+		return ErrInvalidStream
+	}
+	d.counter++
+	d.done = final
+	if d.skip > 0 {
+		if d.skip > len(plain) {
+			return ErrInvalidStream
+		}
+		plain = plain[d.skip:]
+		d.skip = 0
+	}
+	d.plain = plain
+	return nil
+}
+
+// newHeader creates a data key wrapped by the master key
+func newHeader(masterKey string) ([]byte, cipher.AEAD, error) {
+	wrap, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	header := make([]byte, len(streamMagic)+wrapNonceSize, headerSize)
+	copy(header, streamMagic)
+	prefix := make([]byte, prefixSize)
+	for _, buf := range [][]byte{dataKey, header[len(streamMagic):], prefix} {
+		if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+			return nil, nil, err
+		}
+	}
+	header = wrap.Seal(header, header[len(streamMagic):], dataKey, []byte(streamMagic))
+	header = append(header, prefix...)
+
+	aead, err := dataAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, aead, nil
+}
+
+// openHeader unwraps the data key from the header
+func openHeader(header []byte, masterKey string) (cipher.AEAD, error) {
+	if string(header[:len(streamMagic)]) != streamMagic {
+		return nil, ErrInvalidStream
+	}
+	wrap, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := header[len(streamMagic) : len(streamMagic)+wrapNonceSize]
+	wrapped := header[len(streamMagic)+wrapNonceSize : headerSize-prefixSize]
+	dataKey, err := wrap.Open(nil, nonce, wrapped, []byte(streamMagic))
+	if err != nil {
+		return nil, ErrInvalidStream
+	}
+	return dataAEAD(dataKey)
+}
+
+// newAEAD creates an AES-GCM cipher from a hex encoded key
+func newAEAD(keyString string) (cipher.AEAD, error) {
+	key, err := hex.DecodeString(keyString)
+	if err != nil {
+		return nil, err
+	}
+	return dataAEAD(key)
+}
+
+func dataAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce derives the nonce of a chunk from the header prefix
+func chunkNonce(header []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, prefixSize+5)
+	copy(nonce, header[headerSize-prefixSize:])
+	binary.BigEndian.PutUint32(nonce[prefixSize:], counter)
+	if final {
+		nonce[prefixSize+4] = 1
+	}
+	return nonce
+}
@@ -0,0 +1,163 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+)
+
+func testKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(key)
+}
+
+func encrypt(t *testing.T, key string, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewEncryptWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// uneven writes cross chunk boundaries
+	for len(plain) > 0 {
+		n := 1000
+		if n > len(plain) {
+			n = len(plain)
+		}
+		if _, err := w.Write(plain[:n]); err != nil {
+			t.Fatal(err)
+		}
+		plain = plain[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var streamSizes = []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 17}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, size := range streamSizes {
+		plain := make([]byte, size)
+		_, _ = rand.Read(plain)
+		sealed := encrypt(t, key, plain)
+
+		if !IsEncrypted(bytes.NewReader(sealed)) {
+			t.Errorf("size %d: not recognized as encrypted", size)
+		}
+		if got := PlainSize(int64(len(sealed))); got != int64(size) {
+			t.Errorf("size %d: PlainSize = %d", size, got)
+		}
+		// a plain reader exercises the sequential path
+		r, err := NewDecryptReader(io.MultiReader(bytes.NewReader(sealed)), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: decrypted content differs", size)
+		}
+	}
+}
+
+func TestStreamSeek(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 3*ChunkSize+17)
+	_, _ = rand.Read(plain)
+	sealed := encrypt(t, key, plain)
+
+	r, err := NewDecryptReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{0, io.SeekStart, 0},
+		{ChunkSize, io.SeekStart, ChunkSize},
+		{ChunkSize + 5, io.SeekStart, ChunkSize + 5},
+		{-10, io.SeekEnd, int64(len(plain)) - 10},
+		{0, io.SeekEnd, int64(len(plain))},
+		{2 * ChunkSize, io.SeekStart, 2 * ChunkSize},
+		{-ChunkSize, io.SeekCurrent, ChunkSize},
+	}
+	for _, tt := range tests {
+		pos, err := r.Seek(tt.offset, tt.whence)
+		if err != nil || pos != tt.want {
+			t.Fatalf("Seek(%d, %d) = %d, %v, want %d", tt.offset, tt.whence, pos, err, tt.want)
+		}
+		got := make([]byte, 100)
+		n, err := io.ReadFull(r, got)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			t.Fatalf("read at %d: %v", pos, err)
+		}
+		if want := plain[pos:min(pos+100, int64(len(plain)))]; !bytes.Equal(got[:n], want) {
+			t.Errorf("read at %d differs", pos)
+		}
+		// SeekCurrent is relative to the position before the read
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Error("negative position was accepted")
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 2*ChunkSize+100)
+	_, _ = rand.Read(plain)
+	sealed := encrypt(t, key, plain)
+
+	tests := []struct {
+		name   string
+		sealed []byte
+		key    string
+	}{
+		{"flipped byte", flip(sealed, headerSize+ChunkSize+10), key},
+		{"truncated at chunk boundary", sealed[:headerSize+2*sealedSize], key},
+		{"truncated chunk", sealed[:len(sealed)-1], key},
+		{"swapped chunks", swap(sealed, 0, 1), key},
+		{"wrong key", sealed, testKey(t)},
+	}
+	for _, tt := range tests {
+		r, err := NewDecryptReader(bytes.NewReader(tt.sealed), tt.key)
+		if err == nil {
+			_, err = io.ReadAll(r)
+		}
+		if !errors.Is(err, ErrInvalidStream) {
+			t.Errorf("%s: got %v, want ErrInvalidStream", tt.name, err)
+		}
+	}
+}
+
+func flip(sealed []byte, i int) []byte {
+	tampered := append([]byte(nil), sealed...)
+	tampered[i] ^= 1
+	return tampered
+}
+
+func swap(sealed []byte, a, b int) []byte {
+	swapped := append([]byte(nil), sealed...)
+	chunkA := swapped[headerSize+a*sealedSize : headerSize+(a+1)*sealedSize]
+	chunkB := swapped[headerSize+b*sealedSize : headerSize+(b+1)*sealedSize]
+	tmp := append([]byte(nil), chunkA...)
+	copy(chunkA, chunkB)
+	copy(chunkB, tmp)
+	return swapped
+}
@@ -2,10 +2,13 @@ package database
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"fmt"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/sirupsen/logrus"
 )
 
@@ -38,6 +41,7 @@ type Migration interface {
 
 type DatabaseParam struct {
 	ConnectionStr string
+	TLSConfig     *tls.Config
 	DatabaseName  string
 	MaxLifetime   time.Duration
 	MaxIdleConns  int
@@ -60,10 +64,16 @@ func NewConnection(param DatabaseParam, logger *logrus.Logger) Database {
 // connect creates a database connection
 func connect(param DatabaseParam, logger *logrus.Logger) *sql.DB {
 	logger.Info("Creating database connection")
-	conn, err := sql.Open("postgres", param.ConnectionStr)
+	config, err := pgx.ParseConfig(param.ConnectionStr)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	if param.TLSConfig != nil {
+		// ssl material is passed in memory rather than through sslrootcert, sslcert and sslkey files
+		config.TLSConfig = param.TLSConfig
+		config.Fallbacks = nil
+	}
+	conn := stdlib.OpenDB(*config)
 
 	// confirm connection
 	err = conn.Ping()
@@ -0,0 +1,884 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Expression is a compiled condition, a subset of CEL:
+//
+//	literals     'text' "text" 42 1.5 true false null [1, 2]
+//	attributes   subject.actorId resource.tags[0] resource['owner-id']
+//	operators    ! - && || == != < <= > >= in
+//	functions    size(x) has(x.y) inCIDR(ip, cidr)
+//	methods      x.startsWith(y) x.endsWith(y) x.contains(y) x.matches(re) x.lowerAscii()
+//
+// Numbers are float64, and && and || absorb errors on the side that does not
+// decide the result, as in CEL.
+type Expression struct {
+	source string
+	root   node
+}
+
+// Compile parses a condition
+func Compile(source string) (*Expression, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.unexpected(t)
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+// String returns the source of the expression
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Eval evaluates the condition with the variables, which must be values
+// returned by Normalize
+func (e *Expression) Eval(vars map[string]interface{}) (bool, error) {
+	value, err := e.root.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, errors.New("condition is not a bool but " + typeName(value))
+	}
+	return result, nil
+}
+
+// Normalize converts a value to the types expressions use: nil, bool,
+// float64, string, []interface{} and map[string]interface{}. Times become
+// RFC 3339 strings, structs are converted through their JSON encoding.
+func Normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, bool, float64, string:
+		return v
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint:
+		return float64(v)
+	case uint32:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case []string:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = item
+		}
+		return list
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = Normalize(item)
+		}
+		return list
+	case map[string]string:
+		object := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			object[key] = item
+		}
+		return object
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			object[key] = Normalize(item)
+		}
+		return object
+	}
+	content, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(content, &decoded); err != nil {
+		return nil
+	}
+	return decoded
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+// operators are matched longest first
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "-", "(", ")", "[", "]", ",", "."}
+
+func lex(source string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || isLetter(c):
+			start := i
+			for i < len(source) && (source[i] == '_' || isLetter(source[i]) || isDigit(source[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: source[start:i], pos: start})
+		case isDigit(c):
+			start := i
+			for i < len(source) && (isDigit(source[i]) || source[i] == '.') {
+				i++
+			}
+			number, err := strconv.ParseFloat(source[start:i], 64)
+			if err != nil {
+				return nil, errors.New("invalid number " + source[start:i] + " at " + strconv.Itoa(start))
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: source[start:i], value: number, pos: start})
+		case c == '\'' || c == '"':
+			text, end, err := lexString(source, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenString, text: source[i:end], value: text, pos: i})
+			i = end
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				r, _ := utf8.DecodeRuneInString(source[i:])
+				return nil, errors.New("unexpected character " + string(r) + " at " + strconv.Itoa(i))
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(source)}), nil
+}
+
+// lexString reads a quoted string starting at start, returning its end
+func lexString(source string, start int) (string, int, error) {
+	quote := source[start]
+	var b strings.Builder
+	for i := start + 1; i < len(source); i++ {
+		switch c := source[i]; {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(source):
+			i++
+			switch source[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(source[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated string at " + strconv.Itoa(start))
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the operator or keyword when it is next
+func (p *parser) accept(text string) bool {
+	if t := p.peek(); (t.kind == tokenOperator || t.kind == tokenIdent) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected(p.peek())
+	}
+	return nil
+}
+
+func (p *parser) unexpected(t token) error {
+	if t.kind == tokenEOF {
+		return errors.New("unexpected end of expression")
+	}
+	return errors.New("unexpected " + t.text + " at " + strconv.Itoa(t.pos))
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{or: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseRelation()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseRelation()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseRelation() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if p.accept(op) {
+			right, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return &binaryNode{op: op, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	for _, op := range []string{"!", "-"} {
+		if p.accept(op) {
+			operand, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return &unaryNode{op: op, operand: operand}, nil
+		}
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	target, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			name := p.next()
+			if name.kind != tokenIdent {
+				return nil, p.unexpected(name)
+			}
+			if p.accept("(") {
+				args, err := p.parseArgs(")")
+				if err != nil {
+					return nil, err
+				}
+				call, err := newCall(name, target, args)
+				if err != nil {
+					return nil, err
+				}
+				target = call
+				continue
+			}
+			target = &memberNode{target: target, name: name.text}
+		case p.accept("["):
+			key, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			target = &indexNode{target: target, key: key}
+		default:
+			return target, nil
+		}
+	}
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber, tokenString:
+		return &literalNode{value: t.value}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		}
+		if p.accept("(") {
+			args, err := p.parseArgs(")")
+			if err != nil {
+				return nil, err
+			}
+			if t.text == "has" {
+				if len(args) != 1 {
+					return nil, errors.New("has takes a single attribute")
+				}
+				member, ok := args[0].(*memberNode)
+				if !ok {
+					return nil, errors.New("has takes an attribute such as has(resource.owner)")
+				}
+				return &hasNode{member: member}, nil
+			}
+			return newCall(t, nil, args)
+		}
+		return &identNode{name: t.text}, nil
+	case tokenOperator:
+		switch t.text {
+		case "(":
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		case "[":
+			items, err := p.parseArgs("]")
+			if err != nil {
+				return nil, err
+			}
+			return &listNode{items: items}, nil
+		}
+	}
+	return nil, p.unexpected(t)
+}
+
+// parseArgs parses comma separated expressions up to the closing operator
+func (p *parser) parseArgs(closing string) ([]node, error) {
+	var args []node
+	if p.accept(closing) {
+		return args, nil
+	}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.accept(closing) {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// functions are called as f(x), with the number of arguments they take
+var functions = map[string]int{
+	"size":   1,
+	"inCIDR": 2,
+}
+
+// methods are called as x.f(), with the number of arguments they take
+var methods = map[string]int{
+	"size":       0,
+	"contains":   1,
+	"startsWith": 1,
+	"endsWith":   1,
+	"matches":    1,
+	"lowerAscii": 0,
+}
+
+// newCall checks the name and arguments of a call, compiling literal patterns
+func newCall(name token, target node, args []node) (*callNode, error) {
+	arity, ok := functions[name.text]
+	if target != nil {
+		arity, ok = methods[name.text]
+	}
+	if !ok {
+		return nil, errors.New("unknown function " + name.text + " at " + strconv.Itoa(name.pos))
+	}
+	if len(args) != arity {
+		return nil, errors.New(name.text + " takes " + strconv.Itoa(arity) + " arguments, not " + strconv.Itoa(len(args)))
+	}
+	call := &callNode{name: name.text, target: target, args: args}
+	if call.name != "matches" {
+		return call, nil
+	}
+	if literal, ok := args[0].(*literalNode); ok {
+		pattern, ok := literal.value.(string)
+		if !ok {
+			return nil, errors.New("matches needs a string, not " + typeName(literal.value))
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		call.re = re
+	}
+	return call, nil
+}
+
+type node interface {
+	eval(vars map[string]interface{}) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+type identNode struct {
+	name string
+}
+
+func (n *identNode) eval(vars map[string]interface{}) (interface{}, error) {
+	value, ok := vars[n.name]
+	if !ok {
+		return nil, errors.New("undeclared reference to " + n.name)
+	}
+	return value, nil
+}
+
+type memberNode struct {
+	target node
+	name   string
+}
+
+func (n *memberNode) eval(vars map[string]interface{}) (interface{}, error) {
+	target, err := n.target.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	object, ok := target.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("no field " + n.name + " on " + typeName(target))
+	}
+	value, ok := object[n.name]
+	if !ok {
+		return nil, errors.New("no such key: " + n.name)
+	}
+	return value, nil
+}
+
+type hasNode struct {
+	member *memberNode
+}
+
+func (n *hasNode) eval(vars map[string]interface{}) (interface{}, error) {
+	target, err := n.member.target.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	object, ok := target.(map[string]interface{})
+	if !ok {
+		return false, nil
+	}
+	_, ok = object[n.member.name]
+	return ok, nil
+}
+
+type indexNode struct {
+	target node
+	key    node
+}
+
+func (n *indexNode) eval(vars map[string]interface{}) (interface{}, error) {
+	target, err := n.target.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	key, err := n.key.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch t := target.(type) {
+	case map[string]interface{}:
+		name, ok := key.(string)
+		if !ok {
+			return nil, errors.New("map key is not a string but " + typeName(key))
+		}
+		value, ok := t[name]
+		if !ok {
+			return nil, errors.New("no such key: " + name)
+		}
+		return value, nil
+	case []interface{}:
+		index, ok := key.(float64)
+		if !ok || index != float64(int(index)) {
+			return nil, errors.New("list index is not an integer")
+		}
+		if index < 0 || int(index) >= len(t) {
+			return nil, errors.New("index out of range")
+		}
+		return t[int(index)], nil
+	}
+	return nil, errors.New("cannot index " + typeName(target))
+}
+
+type listNode struct {
+	items []node
+}
+
+func (n *listNode) eval(vars map[string]interface{}) (interface{}, error) {
+	list := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		value, err := item.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = value
+	}
+	return list, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n *unaryNode) eval(vars map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		b, ok := value.(bool)
+		if !ok {
+			return nil, errors.New("! needs a bool, not " + typeName(value))
+		}
+		return !b, nil
+	}
+	number, ok := value.(float64)
+	if !ok {
+		return nil, errors.New("- needs a number, not " + typeName(value))
+	}
+	return -number, nil
+}
+
+// logicalNode is && or ||, an error on one side is absorbed when the other
+// side decides the result
+type logicalNode struct {
+	or    bool
+	left  node
+	right node
+}
+
+func (n *logicalNode) eval(vars map[string]interface{}) (interface{}, error) {
+	left, leftErr := evalBool(n.left, vars)
+	if leftErr == nil && left == n.or {
+		return left, nil
+	}
+	right, rightErr := evalBool(n.right, vars)
+	if rightErr == nil && right == n.or {
+		return right, nil
+	}
+	if leftErr != nil {
+		return nil, leftErr
+	}
+	if rightErr != nil {
+		return nil, rightErr
+	}
+	return !n.or, nil
+}
+
+func evalBool(n node, vars map[string]interface{}) (bool, error) {
+	value, err := n.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, errors.New("&& and || need bools, not " + typeName(value))
+	}
+	return b, nil
+}
+
+type binaryNode struct {
+	op    string
+	left  node
+	right node
+}
+
+func (n *binaryNode) eval(vars map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "in":
+		switch r := right.(type) {
+		case []interface{}:
+			for _, item := range r {
+				if equal(left, item) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			key, ok := left.(string)
+			if !ok {
+				return false, nil
+			}
+			_, found := r[key]
+			return found, nil
+		}
+		return nil, errors.New("in needs a list or map, not " + typeName(right))
+	}
+
+	var compared int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, errors.New("cannot compare number with " + typeName(right))
+		}
+		compared = compareFloat(l, r)
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, errors.New("cannot compare string with " + typeName(right))
+		}
+		compared = strings.Compare(l, r)
+	default:
+		return nil, errors.New("cannot compare " + typeName(left))
+	}
+	switch n.op {
+	case "<":
+		return compared < 0, nil
+	case "<=":
+		return compared <= 0, nil
+	case ">":
+		return compared > 0, nil
+	}
+	return compared >= 0, nil
+}
+
+type callNode struct {
+	name   string
+	target node
+	args   []node
+	// re is the compiled pattern of matches with a literal pattern
+	re *regexp.Regexp
+}
+
+func (n *callNode) eval(vars map[string]interface{}) (interface{}, error) {
+	var values []interface{}
+	if n.target != nil {
+		target, err := n.target.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, target)
+	}
+	for _, arg := range n.args {
+		value, err := arg.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	switch n.name {
+	case "size":
+		if len(values) != 1 {
+			return nil, errors.New("size takes one argument")
+		}
+		switch v := values[0].(type) {
+		case string:
+			return float64(utf8.RuneCountInString(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		}
+		return nil, errors.New("no size of " + typeName(values[0]))
+	case "contains":
+		if len(values) != 2 {
+			return nil, errors.New("contains takes one argument")
+		}
+		if list, ok := values[0].([]interface{}); ok {
+			for _, item := range list {
+				if equal(item, values[1]) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		s, sub, err := stringArgs(n.name, values)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Contains(s, sub), nil
+	case "startsWith":
+		s, prefix, err := stringArgs(n.name, values)
+		if err != nil {
+			return nil, err
+		}
+		return strings.HasPrefix(s, prefix), nil
+	case "endsWith":
+		s, suffix, err := stringArgs(n.name, values)
+		if err != nil {
+			return nil, err
+		}
+		return strings.HasSuffix(s, suffix), nil
+	case "matches":
+		s, pattern, err := stringArgs(n.name, values)
+		if err != nil {
+			return nil, err
+		}
+		re := n.re
+		if re == nil {
+			if re, err = regexp.Compile(pattern); err != nil {
+				return nil, err
+			}
+		}
+		return re.MatchString(s), nil
+	case "inCIDR":
+		address, cidr, err := stringArgs(n.name, values)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			return nil, err
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		return prefix.Contains(addr.Unmap()), nil
+	case "lowerAscii":
+		if len(values) != 1 {
+			return nil, errors.New("lowerAscii takes no arguments")
+		}
+		s, ok := values[0].(string)
+		if !ok {
+			return nil, errors.New("lowerAscii needs a string, not " + typeName(values[0]))
+		}
+		return strings.ToLower(s), nil
+	}
+	return nil, errors.New("unknown function " + n.name)
+}
+
+// stringArgs returns the two string values of a function
+func stringArgs(name string, values []interface{}) (string, string, error) {
+	if len(values) != 2 {
+		return "", "", errors.New(name + " takes two strings")
+	}
+	a, ok := values[0].(string)
+	if !ok {
+		return "", "", errors.New(name + " needs strings, not " + typeName(values[0]))
+	}
+	b, ok := values[1].(string)
+	if !ok {
+		return "", "", errors.New(name + " needs strings, not " + typeName(values[1]))
+	}
+	return a, b, nil
+}
+
+func equal(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return reflect.TypeOf(value).String()
+}
@@ -0,0 +1,160 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+var testVars = map[string]interface{}{
+	"subject": map[string]interface{}{
+		"actorId":     float64(7),
+		"permissions": []interface{}{"clerk", "orders:read"},
+	},
+	"resource": map[string]interface{}{
+		"ownerId":  float64(7),
+		"status":   "open",
+		"tags":     []interface{}{"priority", "eu"},
+		"owner-id": "alice",
+		"amount":   float64(120.5),
+		"nested":   map[string]interface{}{"region": "EU-West"},
+	},
+	"env": map[string]interface{}{
+		"ip":   "10.1.2.3",
+		"hour": float64(14),
+	},
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{"true", true},
+		{"!false", true},
+		{"resource.ownerId == subject.actorId", true},
+		{"resource.ownerId != subject.actorId", false},
+		{"resource.status == 'open' && resource.amount > 100", true},
+		{"resource.status == \"shipped\" || resource.amount <= 100", false},
+		{"resource.amount >= 120.5 && resource.amount < 121", true},
+		{"-resource.amount < 0", true},
+		{"'orders:read' in subject.permissions", true},
+		{"'admin' in subject.permissions", false},
+		{"'status' in resource", true},
+		{"resource.tags[0] == 'priority'", true},
+		{"resource['owner-id'] == 'alice'", true},
+		{"size(resource.tags) == 2 && resource.tags.size() == 2", true},
+		{"size('héllo') == 5", true},
+		{"has(resource.status) && !has(resource.deletedAt)", true},
+		{"resource.nested.region.lowerAscii().startsWith('eu')", true},
+		{"resource.nested.region.endsWith('West') && resource.nested.region.contains('-')", true},
+		{"resource.tags.contains('eu')", true},
+		{"resource.status.matches('^op')", true},
+		{"resource.status.matches(resource.nested.region)", false},
+		{"inCIDR(env.ip, '10.0.0.0/8') && !inCIDR(env.ip, '192.168.0.0/16')", true},
+		{"[1, 2, 3] == [1, 2, 3]", true},
+		{"'b' > 'a' && (env.hour >= 9 && env.hour < 17)", true},
+	}
+	for _, tt := range tests {
+		expr, err := Compile(tt.source)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.source, err)
+			continue
+		}
+		got, err := expr.Eval(testVars)
+		if err != nil {
+			t.Errorf("Eval(%q): %v", tt.source, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Eval(%q) = %v, want %v", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{"resource.missing == 1", "no such key"},
+		{"unknown == 1", "undeclared reference"},
+		{"resource.amount", "not a bool"},
+		{"resource.status < 1", "cannot compare"},
+		{"!resource.status", "needs a bool"},
+		{"resource.tags[5] == 'x'", "out of range"},
+		{"inCIDR(resource.status, '10.0.0.0/8')", "ParseAddr"},
+	}
+	for _, tt := range tests {
+		expr, err := Compile(tt.source)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.source, err)
+			continue
+		}
+		if _, err := expr.Eval(testVars); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Eval(%q) error %v, want %q", tt.source, err, tt.err)
+		}
+	}
+}
+
+// TestEvalAbsorbsErrors checks that && and || ignore an error on the side
+// that does not decide the result, as CEL does
+func TestEvalAbsorbsErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{"resource.missing == 1 || true", true},
+		{"true || resource.missing == 1", true},
+		{"resource.missing == 1 && false", false},
+		{"false && resource.missing == 1", false},
+	}
+	for _, tt := range tests {
+		expr, err := Compile(tt.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := expr.Eval(testVars); err != nil || got != tt.want {
+			t.Errorf("Eval(%q) = %v, %v, want %v", tt.source, got, err, tt.want)
+		}
+	}
+	expr, _ := Compile("resource.missing == 1 || false")
+	if _, err := expr.Eval(testVars); err == nil {
+		t.Error("an undecided error was absorbed")
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"resource.status ==",
+		"(true",
+		"'unterminated",
+		"resource.status # 1",
+		"true true",
+		"unknown(1)",
+		"size(1, 2)",
+		"resource.status.unknown()",
+		"resource.status.lowerAscii(1)",
+		"resource.status.startsWith()",
+		"inCIDR(env.ip)",
+		"resource.status.matches('(')",
+		"resource.status.matches(1)",
+		"has(resource)",
+	}
+	for _, source := range tests {
+		if _, err := Compile(source); err == nil {
+			t.Errorf("Compile(%q) succeeded", source)
+		}
+	}
+}
+
+func TestCompilePrecompilesPatterns(t *testing.T) {
+	expr, err := Compile("resource.status.matches('^op')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	call, ok := expr.root.(*callNode)
+	if !ok || call.re == nil {
+		t.Fatal("the literal pattern was not compiled")
+	}
+}
@@ -0,0 +1,349 @@
+// Package policy decides access with attribute based policies, conditions
+// over the subject, action, resource and environment of a request.
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/greatfocus/gf-sframe/server"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrDenied is returned by Authorize when no policy allows the request, or a
+// policy denies it
+var ErrDenied = errors.New("access denied")
+
+// Effect of a policy whose condition holds
+type Effect string
+
+const (
+	// Allow grants the request unless another policy denies it
+	Allow Effect = "allow"
+	// Deny rejects the request, overriding allowing policies
+	Deny Effect = "deny"
+)
+
+// Policy applies its effect to the actions on the resource types it lists
+// when its condition holds. Empty lists and * match every action or type, an
+// empty condition always holds.
+//
+//	{"name": "owner-updates-order", "effect": "allow", "actions": ["update"],
+//	 "resources": ["order"],
+//	 "condition": "resource.ownerId == subject.actorId && resource.status != 'shipped'"}
+type Policy struct {
+	Name      string   `json:"name"`
+	Effect    Effect   `json:"effect"`
+	Actions   []string `json:"actions,omitempty"`
+	Resources []string `json:"resources,omitempty"`
+	Condition string   `json:"condition,omitempty"`
+}
+
+// Resource is the object of a request, its attributes are read by conditions
+// as resource.<name> next to resource.type and resource.id
+type Resource struct {
+	Type       string
+	ID         string
+	Attributes map[string]interface{}
+}
+
+// Environment is the context of a request, read by conditions as env.ip,
+// env.time (RFC 3339), env.hour, env.weekday, env.method, env.path and
+// env.<attribute>
+type Environment struct {
+	IP         string
+	Time       time.Time
+	Method     string
+	Path       string
+	Attributes map[string]interface{}
+}
+
+// Step is the evaluation of one policy
+type Step struct {
+	Policy    string `json:"policy"`
+	Effect    Effect `json:"effect"`
+	Applies   bool   `json:"applies"`
+	Condition string `json:"condition,omitempty"`
+	Result    bool   `json:"result"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Decision is the outcome of a request and the evaluation leading to it
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+	Policy  string `json:"policy,omitempty"`
+	Trace   []Step `json:"trace"`
+}
+
+// Source loads the policies of an engine
+type Source func(ctx context.Context) ([]Policy, error)
+
+// Engine evaluates policies. A request is allowed when an allowing policy
+// holds and no denying policy holds. Conditions failing to evaluate, such as
+// on a missing attribute, hold for denying policies only.
+type Engine struct {
+	source   Source
+	logger   *logrus.Logger
+	mu       sync.RWMutex
+	policies []compiled
+}
+
+type compiled struct {
+	Policy
+	condition *Expression
+}
+
+// NewEngine creates an engine and loads its policies
+func NewEngine(source Source, logger *logrus.Logger) (*Engine, error) {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	e := &Engine{
+		source: source,
+		logger: logger,
+	}
+	if err := e.Reload(context.Background()); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload replaces the policies with the current source content, the previous
+// policies are kept when the source fails or holds an invalid policy
+func (e *Engine) Reload(ctx context.Context) error {
+	policies, err := e.source(ctx)
+	if err != nil {
+		return err
+	}
+	list := make([]compiled, 0, len(policies))
+	for _, p := range policies {
+		if p.Effect != Allow && p.Effect != Deny {
+			return errors.New("policy " + p.Name + " has invalid effect " + string(p.Effect))
+		}
+		c := compiled{Policy: p}
+		if p.Condition != "" {
+			c.condition, err = Compile(p.Condition)
+			if err != nil {
+				return errors.New("policy " + p.Name + ": " + err.Error())
+			}
+		}
+		list = append(list, c)
+	}
+
+	e.mu.Lock()
+	e.policies = list
+	e.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the policies periodically until the context is cancelled,
+// the interval must be positive
+func (e *Engine) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		e.logger.Error("Watching policies needs a positive interval")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.Reload(ctx); err != nil {
+				e.logger.Error("Reloading policies failed, because of " + err.Error())
+			}
+		}
+	}
+}
+
+// Authorize returns ErrDenied unless the policies allow the action on the
+// resource, for the token and environment of the context
+func (e *Engine) Authorize(ctx context.Context, action string, resource Resource) error {
+	if decision := e.Explain(ctx, action, resource); !decision.Allowed {
+		return ErrDenied
+	}
+	return nil
+}
+
+// Explain decides the action on the resource and traces every policy
+func (e *Engine) Explain(ctx context.Context, action string, resource Resource) Decision {
+	token, _ := server.TokenFromContext(ctx)
+	env, ok := EnvironmentFromContext(ctx)
+	if !ok {
+		env = Environment{Time: time.Now()}
+	}
+	return e.Evaluate(token, action, resource, env)
+}
+
+// Evaluate decides the action of the token on the resource in env
+func (e *Engine) Evaluate(token *server.TokenInfo, action string, resource Resource, env Environment) Decision {
+	vars := map[string]interface{}{
+		"subject":  subjectVars(token),
+		"action":   action,
+		"resource": resourceVars(resource),
+		"env":      environmentVars(env),
+	}
+
+	e.mu.RLock()
+	policies := e.policies
+	e.mu.RUnlock()
+
+	decision := Decision{Trace: make([]Step, 0, len(policies))}
+	var allowedBy, deniedBy string
+	for _, p := range policies {
+		step := Step{Policy: p.Name, Effect: p.Effect, Condition: p.Condition}
+		step.Applies = matches(p.Actions, action) && matches(p.Resources, resource.Type)
+		if step.Applies {
+			step.Result = true
+			if p.condition != nil {
+				result, err := p.condition.Eval(vars)
+				step.Result = result
+				if err != nil {
+					step.Result = p.Effect == Deny
+					step.Error = err.Error()
+				}
+			}
+		}
+		decision.Trace = append(decision.Trace, step)
+
+		if !step.Result {
+			continue
+		}
+		if p.Effect == Deny && deniedBy == "" {
+			deniedBy = p.Name
+		}
+		if p.Effect == Allow && allowedBy == "" {
+			allowedBy = p.Name
+		}
+	}
+
+	switch {
+	case deniedBy != "":
+		decision.Policy = deniedBy
+		decision.Reason = "denied by policy " + deniedBy
+	case allowedBy != "":
+		decision.Allowed = true
+		decision.Policy = allowedBy
+		decision.Reason = "allowed by policy " + allowedBy
+	default:
+		decision.Reason = "no policy allows " + action + " on " + resource.Type
+	}
+	return decision
+}
+
+// Middleware records the environment of requests for Authorize
+func Middleware() server.Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			env := Environment{
+				IP:     server.ClientIP(r),
+				Time:   time.Now(),
+				Method: r.Method,
+				Path:   r.URL.Path,
+			}
+
+			// continue
+			h.ServeHTTP(w, r.WithContext(WithEnvironment(r.Context(), env)))
+		})
+	}
+}
+
+type contextKey string
+
+const environmentKey contextKey = "policyEnvironment"
+
+// WithEnvironment returns a context carrying the environment of a request
+func WithEnvironment(ctx context.Context, env Environment) context.Context {
+	return context.WithValue(ctx, environmentKey, env)
+}
+
+// EnvironmentFromContext returns the environment recorded by Middleware
+func EnvironmentFromContext(ctx context.Context) (Environment, bool) {
+	env, ok := ctx.Value(environmentKey).(Environment)
+	return env, ok
+}
+
+// Static returns fixed policies
+func Static(policies ...Policy) Source {
+	return func(context.Context) ([]Policy, error) {
+		return policies, nil
+	}
+}
+
+// File reads a JSON file of {"policies": [...]}
+func File(path string) Source {
+	return func(context.Context) ([]Policy, error) {
+		content, err := os.ReadFile(filepath.Clean(path))
+		if err != nil {
+			return nil, err
+		}
+		var file struct {
+			Policies []Policy `json:"policies"`
+		}
+		if err := json.Unmarshal(content, &file); err != nil {
+			return nil, err
+		}
+		return file.Policies, nil
+	}
+}
+
+func matches(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == "*" || v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// subjectVars are the token claims, with sub, or an empty subject for
+// anonymous requests
+func subjectVars(token *server.TokenInfo) map[string]interface{} {
+	if token == nil {
+		return map[string]interface{}{}
+	}
+	vars, _ := Normalize(token).(map[string]interface{})
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+	if _, ok := vars["permissions"]; !ok {
+		vars["permissions"] = []interface{}{}
+	}
+	vars["sub"] = token.TokenSubject()
+	return vars
+}
+
+func resourceVars(resource Resource) map[string]interface{} {
+	vars := make(map[string]interface{}, len(resource.Attributes)+2)
+	for key, value := range resource.Attributes {
+		vars[key] = Normalize(value)
+	}
+	vars["type"] = resource.Type
+	vars["id"] = resource.ID
+	return vars
+}
+
+func environmentVars(env Environment) map[string]interface{} {
+	vars := make(map[string]interface{}, len(env.Attributes)+6)
+	for key, value := range env.Attributes {
+		vars[key] = Normalize(value)
+	}
+	vars["ip"] = env.IP
+	vars["time"] = env.Time.Format(time.RFC3339)
+	vars["hour"] = float64(env.Time.Hour())
+	vars["weekday"] = env.Time.Weekday().String()
+	vars["method"] = env.Method
+	vars["path"] = env.Path
+	return vars
+}
@@ -0,0 +1,76 @@
+package policy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/greatfocus/gf-sframe/server"
+)
+
+func TestEngineEvaluate(t *testing.T) {
+	engine, err := NewEngine(Static(
+		Policy{Name: "owner-updates", Effect: Allow, Actions: []string{"update"}, Resources: []string{"order"},
+			Condition: "resource.ownerId == subject.actorId"},
+		Policy{Name: "readers", Effect: Allow, Actions: []string{"read"},
+			Condition: "'orders:read' in subject.permissions"},
+		Policy{Name: "shipped-frozen", Effect: Deny, Actions: []string{"*"}, Resources: []string{"order"},
+			Condition: "resource.status == 'shipped'"},
+	), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owner := &server.TokenInfo{ActorID: 7}
+	reader := &server.TokenInfo{ActorID: 8, Permissions: []string{"orders:read"}}
+	order := func(status string) Resource {
+		return Resource{Type: "order", ID: "1", Attributes: map[string]interface{}{"ownerId": int64(7), "status": status}}
+	}
+	tests := []struct {
+		name     string
+		token    *server.TokenInfo
+		action   string
+		resource Resource
+		allowed  bool
+		policy   string
+	}{
+		{"owner updates", owner, "update", order("open"), true, "owner-updates"},
+		{"other actor cannot update", reader, "update", order("open"), false, ""},
+		{"reader reads", reader, "read", order("open"), true, "readers"},
+		{"deny overrides allow", owner, "update", order("shipped"), false, "shipped-frozen"},
+		{"unmatched action", owner, "delete", order("open"), false, ""},
+		{"anonymous", nil, "read", order("open"), false, ""},
+		// a failing condition holds for denying policies only
+		{"missing attribute denies", owner, "update", Resource{Type: "order", Attributes: map[string]interface{}{"ownerId": 7}}, false, "shipped-frozen"},
+	}
+	for _, tt := range tests {
+		decision := engine.Evaluate(tt.token, tt.action, tt.resource, Environment{Time: time.Now()})
+		if decision.Allowed != tt.allowed || decision.Policy != tt.policy {
+			t.Errorf("%s: allowed %v by %q (%s), want %v by %q", tt.name, decision.Allowed, decision.Policy, decision.Reason, tt.allowed, tt.policy)
+		}
+		if len(decision.Trace) != 3 {
+			t.Errorf("%s: traced %d policies", tt.name, len(decision.Trace))
+		}
+	}
+}
+
+func TestEngineKeepsPoliciesOnInvalidReload(t *testing.T) {
+	current := []Policy{{Name: "all", Effect: Allow}}
+	engine, err := NewEngine(func(ctx context.Context) ([]Policy, error) { return current, nil }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, invalid := range [][]Policy{
+		{{Name: "bad-effect", Effect: "maybe"}},
+		{{Name: "bad-condition", Effect: Allow, Condition: "unknown(1)"}},
+	} {
+		current = invalid
+		if err := engine.Reload(context.Background()); err == nil {
+			t.Errorf("%s was loaded", invalid[0].Name)
+		}
+		if !engine.Evaluate(nil, "read", Resource{Type: "order"}, Environment{}).Allowed {
+			t.Errorf("%s replaced the previous policies", invalid[0].Name)
+		}
+	}
+}
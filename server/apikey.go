@@ -0,0 +1,439 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/greatfocus/gf-sframe/database"
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// APIKeySchema creates the tables of API keys and their daily usage
+const APIKeySchema = `
+CREATE TABLE IF NOT EXISTS api_keys (
+	id TEXT PRIMARY KEY,
+	key_hash TEXT NOT NULL,
+	name TEXT NOT NULL,
+	actor_id BIGINT NOT NULL,
+	scopes TEXT NOT NULL DEFAULT '',
+	rate_limit DOUBLE PRECISION NOT NULL DEFAULT 0,
+	burst INTEGER NOT NULL DEFAULT 0,
+	daily_quota BIGINT NOT NULL DEFAULT 0,
+	expires_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	last_used_at TIMESTAMPTZ,
+	revoked_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS api_keys_actor ON api_keys (actor_id);
+CREATE TABLE IF NOT EXISTS api_key_usage (
+	key_id TEXT NOT NULL,
+	day DATE NOT NULL,
+	count BIGINT NOT NULL,
+	PRIMARY KEY (key_id, day)
+);`
+
+// APIKeyHeader carries the API key, Authorization: ApiKey <key> is accepted too
+const APIKeyHeader = "X-API-Key"
+
+var (
+	// ErrInvalidAPIKey is returned for unknown, revoked or expired API keys
+	ErrInvalidAPIKey = errors.New("invalid api key")
+	// ErrQuotaExceeded is returned when a key used its daily quota
+	ErrQuotaExceeded = errors.New("daily quota exceeded")
+	// ErrAPIKeyCreatesKey is returned when a request authenticated by an API
+	// key creates a key
+	ErrAPIKeyCreatesKey = errors.New("api keys cannot create api keys")
+)
+
+// APIKey describes a key, the secret is only known when it is created
+type APIKey struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	ActorID int64  `json:"actorId"`
+	// Scopes are the permissions of the key, checked by IsAuthorized and Roles
+	Scopes []string `json:"scopes"`
+	// RateLimit is the requests per second refilled up to Burst, the API keys
+	// default when zero
+	RateLimit float64 `json:"rateLimit,omitempty"`
+	Burst     int     `json:"burst,omitempty"`
+	// DailyQuota caps the requests per UTC day, unlimited when zero
+	DailyQuota int64     `json:"dailyQuota,omitempty"`
+	ExpiresAt  time.Time `json:"expiresAt,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// APIKeys authenticates partners with keys of the form
+// <prefix>_<id>_<secret>, stored as a hash of the secret in postgres. Keys
+// are cached for CheckInterval, so a revocation on another replica takes
+// effect within it.
+type APIKeys struct {
+	// Prefix identifies the keys, such as in secret scanners
+	Prefix string
+	// RateLimit and Burst apply to keys without their own limits
+	RateLimit float64
+	Burst     int
+	// CheckInterval is how long a key is cached
+	CheckInterval time.Duration
+	db            database.Database
+	logger        *logrus.Logger
+	keys          *cache.Cache
+	mu            sync.Mutex
+	throttles     map[string]Throttle
+	touched       map[string]time.Time
+}
+
+// NewAPIKeys creates keys starting with prefix. APIKeySchema must have been
+// applied to the database.
+func NewAPIKeys(db database.Database, prefix string, logger *logrus.Logger) *APIKeys {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	return &APIKeys{
+		Prefix:        prefix,
+		RateLimit:     float64(DefaultThrottleConfig.Rate),
+		Burst:         DefaultThrottleConfig.Burst,
+		CheckInterval: 30 * time.Second,
+		db:            db,
+		logger:        logger,
+		keys:          cache.New(30*time.Second, time.Minute),
+		throttles:     make(map[string]Throttle),
+		touched:       make(map[string]time.Time),
+	}
+}
+
+// Create issues a key, returning the secret key only this once
+func (k *APIKeys) Create(ctx context.Context, key APIKey) (string, *APIKey, error) {
+	secret, err := newRefreshToken()
+	if err != nil {
+		return "", nil, err
+	}
+	key.ID = randomHex(8)
+	key.CreatedAt = time.Now()
+	key.LastUsedAt = time.Time{}
+	var expires interface{}
+	if !key.ExpiresAt.IsZero() {
+		expires = key.ExpiresAt
+	}
+	_, ok := k.db.Insert(ctx, `
+		INSERT INTO api_keys (id, key_hash, name, actor_id, scopes, rate_limit, burst, daily_quota, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		key.ID, hashRefreshToken(secret), key.Name, key.ActorID, strings.Join(key.Scopes, " "),
+		key.RateLimit, key.Burst, key.DailyQuota, expires, key.CreatedAt)
+	if !ok {
+		return "", nil, errors.New("storing api key failed")
+	}
+	return k.Prefix + "_" + key.ID + "_" + secret, &key, nil
+}
+
+// List returns the active keys of an actor
+func (k *APIKeys) List(ctx context.Context, actorID int64) ([]APIKey, error) {
+	rows, err := k.db.Query(ctx, `
+		SELECT `+apiKeyColumns+` FROM api_keys
+		WHERE actor_id = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+		ORDER BY created_at`, actorID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		var hash string
+		if err := rows.Scan(apiKeyDest(&key, &hash)...); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Revoke revokes a key of the actor
+func (k *APIKeys) Revoke(ctx context.Context, actorID int64, id string) error {
+	k.keys.Delete(id)
+	if !k.db.Update(ctx, "UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND actor_id = $2 AND revoked_at IS NULL", id, actorID) {
+		return ErrInvalidAPIKey
+	}
+	return nil
+}
+
+// Authenticate returns the key of the plaintext key
+func (k *APIKeys) Authenticate(ctx context.Context, plaintext string) (*APIKey, error) {
+	rest, ok := strings.CutPrefix(plaintext, k.Prefix+"_")
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return nil, ErrInvalidAPIKey
+	}
+
+	stored, err := k.lookup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashRefreshToken(secret)), []byte(stored.hash)) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	if !stored.key.ExpiresAt.IsZero() && time.Now().After(stored.key.ExpiresAt) {
+		return nil, ErrInvalidAPIKey
+	}
+	key := stored.key
+	return &key, nil
+}
+
+// Middleware authenticates requests with an API key instead of a token. The
+// key is presented to IsAuthorized and TokenFromContext as a token of its
+// actor with the key scopes as permissions.
+func (k *APIKeys) Middleware() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, err := k.Authenticate(r.Context(), apiKey(r))
+			if errors.Is(err, ErrInvalidAPIKey) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				k.logger.Error("Looking up api key failed, because of " + err.Error())
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			result := k.throttle(key).Take(key.ID)
+			setRateLimitHeaders(w.Header(), result)
+			if !result.Allowed {
+				(w).WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			if err := k.use(r.Context(), key); err != nil {
+				if errors.Is(err, ErrQuotaExceeded) {
+					w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(untilTomorrow())))
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				k.logger.Error("Counting api key use failed, because of " + err.Error())
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			token := &TokenInfo{ActorID: key.ActorID, Permissions: key.Scopes, APIKey: key.ID}
+
+			// continue
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey, token)))
+		})
+	}
+}
+
+// APIKeysHandler manages the keys of the authenticated actor: GET lists them,
+// POST creates one from the name and scopes params, returning its secret key,
+// and DELETE revokes the key of the id param. Scopes must be granted to the
+// actor, and keys cannot create keys.
+func (s *Server) APIKeysHandler(keys *APIKeys) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := TokenFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			list, err := keys.List(r.Context(), token.ActorID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				s.Error(w, r, err)
+				return
+			}
+			s.Success(w, r, list)
+		case http.MethodPost:
+			if token.APIKey != "" {
+				w.WriteHeader(http.StatusForbidden)
+				s.Error(w, r, ErrAPIKeyCreatesKey)
+				return
+			}
+			params, err := s.Request(w, r)
+			if err != nil {
+				return
+			}
+			values, _ := params.(map[string]interface{})
+			name, _ := values["name"].(string)
+			scopes, _ := values["scopes"].(string)
+
+			// a key is granted no more than the actor creating it
+			roles := currentRoles()
+			grants, err := roles.grants(r.Context(), token)
+			if err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if missing, lacking := roles.Missing(grants, roles.Permissions(strings.Fields(scopes))...); lacking {
+				forbidden(w, missing)
+				return
+			}
+
+			plaintext, key, err := keys.Create(r.Context(), APIKey{Name: name, ActorID: token.ActorID, Scopes: strings.Fields(scopes)})
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				s.Error(w, r, err)
+				return
+			}
+			s.Success(w, r, struct {
+				Key    string  `json:"key"`
+				APIKey *APIKey `json:"apiKey"`
+			}{Key: plaintext, APIKey: key})
+		case http.MethodDelete:
+			if err := keys.Revoke(r.Context(), token.ActorID, r.URL.Query().Get("id")); err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				s.Error(w, r, err)
+				return
+			}
+			s.Success(w, r, struct{}{})
+		default:
+			w.Header().Add("Allow", "GET, POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+type storedAPIKey struct {
+	key  APIKey
+	hash string
+}
+
+// lookup returns the active key of id, cached for CheckInterval
+func (k *APIKeys) lookup(ctx context.Context, id string) (*storedAPIKey, error) {
+	if value, found := k.keys.Get(id); found {
+		if value == nil {
+			return nil, ErrInvalidAPIKey
+		}
+		return value.(*storedAPIKey), nil
+	}
+	stored := &storedAPIKey{}
+	found, err := scanRow(ctx, k.db, `
+		SELECT `+apiKeyColumns+` FROM api_keys WHERE id = $1 AND revoked_at IS NULL`,
+		[]interface{}{id}, apiKeyDest(&stored.key, &stored.hash)...)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		// unknown ids are cached too, guessing ids costs no queries
+		k.keys.Set(id, nil, k.CheckInterval)
+		return nil, ErrInvalidAPIKey
+	}
+	k.keys.Set(id, stored, k.CheckInterval)
+	return stored, nil
+}
+
+// use counts the request against the daily quota and records the last use,
+// at most once a minute. Rejected requests are not counted.
+func (k *APIKeys) use(ctx context.Context, key *APIKey) error {
+	if key.DailyQuota > 0 {
+		// no row is returned once the quota is used
+		var count int64
+		counted, err := scanRow(ctx, k.db, `
+			INSERT INTO api_key_usage (key_id, day, count) VALUES ($1, (now() AT TIME ZONE 'utc')::date, 1)
+			ON CONFLICT (key_id, day) DO UPDATE SET count = api_key_usage.count + 1
+			WHERE api_key_usage.count < $2
+			RETURNING count`, []interface{}{key.ID, key.DailyQuota}, &count)
+		if err != nil {
+			return err
+		}
+		if !counted {
+			return ErrQuotaExceeded
+		}
+	}
+
+	now := time.Now()
+	k.mu.Lock()
+	recent := now.Sub(k.touched[key.ID]) < time.Minute
+	if !recent {
+		k.touched[key.ID] = now
+	}
+	k.mu.Unlock()
+	if !recent {
+		k.db.Update(ctx, "UPDATE api_keys SET last_used_at = $2 WHERE id = $1", key.ID, now)
+	}
+	return nil
+}
+
+// throttle returns the throttle shared by the keys with the limits of key
+func (k *APIKeys) throttle(key *APIKey) Throttle {
+	limit, burst := key.RateLimit, key.Burst
+	if limit <= 0 {
+		limit, burst = k.RateLimit, k.Burst
+	}
+	if burst <= 0 {
+		burst = int(limit) + 1
+	}
+	name := strconv.FormatFloat(limit, 'g', -1, 64) + "/" + strconv.Itoa(burst)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	throttle, ok := k.throttles[name]
+	if !ok {
+		throttle = NewKeyedThrottle(ThrottleConfig{Rate: rate.Limit(limit), Burst: burst})
+		k.throttles[name] = throttle
+	}
+	return throttle
+}
+
+const apiKeyColumns = "id, key_hash, name, actor_id, scopes, rate_limit, burst, daily_quota, expires_at, created_at, last_used_at"
+
+// apiKeyDest scans apiKeyColumns into key, nullable times are set by their Scan
+func apiKeyDest(key *APIKey, hash *string) []interface{} {
+	return []interface{}{
+		&key.ID, hash, &key.Name, &key.ActorID, (*scopesColumn)(&key.Scopes),
+		&key.RateLimit, &key.Burst, &key.DailyQuota,
+		(*nullTime)(&key.ExpiresAt), &key.CreatedAt, (*nullTime)(&key.LastUsedAt),
+	}
+}
+
+// scopesColumn scans space separated scopes
+type scopesColumn []string
+
+func (s *scopesColumn) Scan(value interface{}) error {
+	var column sql.NullString
+	if err := column.Scan(value); err != nil {
+		return err
+	}
+	*s = strings.Fields(column.String)
+	return nil
+}
+
+// nullTime scans NULL as the zero time
+type nullTime time.Time
+
+func (t *nullTime) Scan(value interface{}) error {
+	var column sql.NullTime
+	if err := column.Scan(value); err != nil {
+		return err
+	}
+	*t = nullTime(column.Time)
+	return nil
+}
+
+// apiKey returns the key of the X-API-Key or Authorization: ApiKey header
+func apiKey(r *http.Request) string {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+	if scheme, key, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "ApiKey") {
+		return strings.TrimSpace(key)
+	}
+	return ""
+}
+
+func untilTomorrow() time.Duration {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Sub(now)
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Resolver resolves client addresses for the middleware, configured from
+// TRUSTED_PROXIES and TRUSTED_PROXY_HEADER when the server is created
+var Resolver = &IPResolver{}
+
+const clientIPKey contextKey = "clientIP"
+
+// IPResolver resolves the client address of requests passing through trusted proxies
+type IPResolver struct {
+	// Header is the one forwarding header the trusted proxies set, such as
+	// X-Forwarded-For, Forwarded or X-Real-IP. Any other is ignored, since
+	// clients can send them through the proxy.
+	Header  string
+	trusted []netip.Prefix
+}
+
+// NewIPResolver creates a resolver trusting the comma separated proxy addresses
+// and CIDR ranges, reading the X-Forwarded-For header they set
+func NewIPResolver(trustedProxies string) (*IPResolver, error) {
+	resolver := &IPResolver{Header: "X-Forwarded-For"}
+	for _, value := range strings.Split(trustedProxies, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		resolver.trusted = append(resolver.trusted, prefix)
+	}
+	return resolver, nil
+}
+
+// initIPResolver configures the resolver from TRUSTED_PROXIES, reading the
+// TRUSTED_PROXY_HEADER header when set
+func initIPResolver() *IPResolver {
+	resolver, err := NewIPResolver(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		// an invalid list must not silently trust forwarded headers
+		log.Fatal(err)
+	}
+	if header := os.Getenv("TRUSTED_PROXY_HEADER"); header != "" {
+		resolver.Header = header
+	}
+	return resolver
+}
+
+// Resolve returns the client address. The forwarding header is only read when
+// the peer is a trusted proxy, and is walked from the right skipping trusted
+// hops, so addresses prepended by the client cannot be spoofed.
+func (i *IPResolver) Resolve(r *http.Request) string {
+	remote := remoteIP(r.RemoteAddr)
+	if !remote.IsValid() {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		return host
+	}
+	if !i.isTrusted(remote) {
+		return remote.String()
+	}
+
+	hops := forwardedFor(r.Header, i.Header)
+
+	client := remote
+	for j := len(hops) - 1; j >= 0; j-- {
+		addr, err := parseHop(hops[j])
+		if err != nil {
+			// obfuscated or malformed hops end the trusted chain
+			break
+		}
+		client = addr
+		if !i.isTrusted(addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+func (i *IPResolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range i.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveClientIP stores the resolved client address in the request context
+func ResolveClientIP(resolver *IPResolver) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), clientIPKey, resolver.Resolve(r))
+
+			// continue
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ClientIP returns the client address of the request
+func ClientIP(r *http.Request) string {
+	if value, ok := r.Context().Value(clientIPKey).(string); ok {
+		return value
+	}
+	return Resolver.Resolve(r)
+}
+
+// forwardedFor returns the addresses of the named header from the first to
+// the last hop, the for= values of Forwarded (RFC 7239) or the comma
+// separated entries of any other header
+func forwardedFor(header http.Header, name string) []string {
+	var hops []string
+	for _, line := range header.Values(name) {
+		for _, element := range strings.Split(line, ",") {
+			if !strings.EqualFold(name, "Forwarded") {
+				if value := strings.TrimSpace(element); value != "" {
+					hops = append(hops, value)
+				}
+				continue
+			}
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, value)
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses "192.0.2.1", "192.0.2.1:80", "[2001:db8::1]:80" and their quoted forms
+func parseHop(value string) (netip.Addr, error) {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// parsePrefix parses a CIDR range or a single address
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96), nil
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, errors.New("invalid address " + value)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func remoteIP(remoteAddr string) netip.Addr {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
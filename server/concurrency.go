@@ -0,0 +1,381 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority orders queued requests, lower values are admitted first and shed last
+type Priority int
+
+const (
+	// PriorityCritical is for probes and administration
+	PriorityCritical Priority = iota
+	PriorityHigh
+	PriorityNormal
+	PriorityLow
+)
+
+// PriorityFunc classifies a request
+type PriorityFunc func(r *http.Request) Priority
+
+// DefaultPriority makes the info probe critical and every other request normal
+func DefaultPriority(r *http.Request) Priority {
+	if strings.HasSuffix(r.URL.Path, "/info") {
+		return PriorityCritical
+	}
+	return PriorityNormal
+}
+
+// PriorityByPath classifies requests by the longest matching path prefix
+func PriorityByPath(prefixes map[string]Priority, fallback Priority) PriorityFunc {
+	return func(r *http.Request) Priority {
+		priority, length := fallback, -1
+		for prefix, p := range prefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) && len(prefix) > length {
+				priority, length = p, len(prefix)
+			}
+		}
+		return priority
+	}
+}
+
+// ConcurrencyConfig configures an adaptive concurrency limiter
+type ConcurrencyConfig struct {
+	// Name publishes the limiter state as concurrency.<Name>, served by the
+	// metrics path of the server
+	Name         string
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// Tolerance is how many times slower than the lowest observed latency a
+	// request may be before the limit is decreased
+	Tolerance float64
+	// Backoff multiplies the limit when latency exceeds the tolerance
+	Backoff float64
+	// MaxQueue is the number of requests waiting for capacity, a negative
+	// value sheds every request above the limit
+	MaxQueue int
+	// QueueTimeout is how long a request waits before it is shed
+	QueueTimeout time.Duration
+	// Window is how long the lowest latency is remembered
+	Window   time.Duration
+	Priority PriorityFunc
+}
+
+// DefaultConcurrencyConfig starts at 20 concurrent requests and adapts between 5 and 1000
+var DefaultConcurrencyConfig = ConcurrencyConfig{
+	InitialLimit: 20,
+	MinLimit:     5,
+	MaxLimit:     1000,
+	Tolerance:    2,
+	Backoff:      0.9,
+	MaxQueue:     100,
+	QueueTimeout: time.Second,
+	Window:       time.Minute,
+	Priority:     DefaultPriority,
+}
+
+// ConcurrencyStats is the state of a concurrency limiter
+type ConcurrencyStats struct {
+	Limit      int     `json:"limit"`
+	InFlight   int     `json:"inFlight"`
+	Queued     int     `json:"queued"`
+	Shed       int64   `json:"shed"`
+	LatencyMs  float64 `json:"latencyMs"`
+	MinLatency float64 `json:"minLatencyMs"`
+}
+
+// ConcurrencyLimiter bounds concurrent requests with a limit adapted to the
+// observed latency: the limit grows by one per round trip while latency stays
+// close to the lowest observed and shrinks multiplicatively when it rises.
+// Requests above the limit queue by priority and are shed with 503 when the
+// queue is full or they waited too long.
+type ConcurrencyLimiter struct {
+	config      ConcurrencyConfig
+	mu          sync.Mutex
+	limit       float64
+	inFlight    int
+	queue       waitQueue
+	sequence    uint64
+	shed        int64
+	latency     time.Duration
+	minLatency  time.Duration
+	prevMin     time.Duration
+	windowStart time.Time
+	decreased   time.Time
+}
+
+// NewConcurrencyLimiter creates a limiter, zero fields take the default configuration
+func NewConcurrencyLimiter(config ConcurrencyConfig) *ConcurrencyLimiter {
+	defaults := DefaultConcurrencyConfig
+	if config.InitialLimit <= 0 {
+		config.InitialLimit = defaults.InitialLimit
+	}
+	if config.MinLimit <= 0 {
+		config.MinLimit = defaults.MinLimit
+	}
+	if config.MaxLimit <= 0 {
+		config.MaxLimit = defaults.MaxLimit
+	}
+	if config.Tolerance <= 1 {
+		config.Tolerance = defaults.Tolerance
+	}
+	if config.Backoff <= 0 || config.Backoff >= 1 {
+		config.Backoff = defaults.Backoff
+	}
+	if config.MaxQueue == 0 {
+		config.MaxQueue = defaults.MaxQueue
+	} else if config.MaxQueue < 0 {
+		config.MaxQueue = 0
+	}
+	if config.QueueTimeout <= 0 {
+		config.QueueTimeout = defaults.QueueTimeout
+	}
+	if config.Window <= 0 {
+		config.Window = defaults.Window
+	}
+	if config.Priority == nil {
+		config.Priority = defaults.Priority
+	}
+
+	c := &ConcurrencyLimiter{
+		config:      config,
+		limit:       float64(config.InitialLimit),
+		windowStart: time.Now(),
+	}
+	if config.Name != "" {
+		publishMetric("concurrency."+config.Name, func() interface{} {
+			return c.Stats()
+		})
+	}
+	return c
+}
+
+// Stats returns the current limiter state
+func (c *ConcurrencyLimiter) Stats() ConcurrencyStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return ConcurrencyStats{
+		Limit:      int(c.limit),
+		InFlight:   c.inFlight,
+		Queued:     c.queue.Len(),
+		Shed:       c.shed,
+		LatencyMs:  float64(c.latency) / float64(time.Millisecond),
+		MinLatency: float64(c.baseline()) / float64(time.Millisecond),
+	}
+}
+
+// Acquire waits for capacity, returning a release function to call with the
+// outcome of the request, or false when the request is shed
+func (c *ConcurrencyLimiter) Acquire(ctx context.Context, priority Priority) (func(failed bool), bool) {
+	c.mu.Lock()
+	if c.inFlight < int(c.limit) && c.queue.Len() == 0 {
+		c.inFlight++
+		c.mu.Unlock()
+		return c.releaser(time.Now()), true
+	}
+
+	if c.queue.Len() >= c.config.MaxQueue {
+		// shed the lowest priority waiter when this request outranks it
+		lowest := c.queue.lowest()
+		if lowest == nil || lowest.priority <= priority {
+			c.shed++
+			c.mu.Unlock()
+			return nil, false
+		}
+		heap.Remove(&c.queue, lowest.index)
+		c.shed++
+		close(lowest.ready)
+	}
+	c.sequence++
+	w := &waiter{priority: priority, sequence: c.sequence, ready: make(chan bool, 1)}
+	heap.Push(&c.queue, w)
+	c.mu.Unlock()
+
+	timer := time.NewTimer(c.config.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case admitted := <-w.ready:
+		if admitted {
+			return c.releaser(time.Now()), true
+		}
+		return nil, false
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if w.index >= 0 {
+		heap.Remove(&c.queue, w.index)
+		c.shed++
+		return nil, false
+	}
+	// admitted or shed while timing out
+	if admitted := <-w.ready; admitted {
+		return c.releaser(time.Now()), true
+	}
+	return nil, false
+}
+
+// releaser records the latency of the request and admits the next waiter
+func (c *ConcurrencyLimiter) releaser(start time.Time) func(failed bool) {
+	var once sync.Once
+	return func(failed bool) {
+		once.Do(func() {
+			c.release(time.Since(start), failed)
+		})
+	}
+}
+
+func (c *ConcurrencyLimiter) release(latency time.Duration, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	utilized := c.inFlight >= int(c.limit)
+	c.inFlight--
+
+	if now.Sub(c.windowStart) > c.config.Window {
+		c.prevMin, c.minLatency, c.windowStart = c.minLatency, 0, now
+	}
+	if !failed && (c.minLatency == 0 || latency < c.minLatency) {
+		c.minLatency = latency
+	}
+	if c.latency == 0 {
+		c.latency = latency
+	} else {
+		c.latency = (c.latency*9 + latency) / 10
+	}
+
+	baseline := c.baseline()
+	slow := baseline > 0 && float64(latency) > float64(baseline)*c.config.Tolerance
+	switch {
+	case failed || slow:
+		// decrease at most once per round trip so one burst of slow requests
+		// does not collapse the limit
+		if now.Sub(c.decreased) > c.latency {
+			c.limit = math.Max(float64(c.config.MinLimit), c.limit*c.config.Backoff)
+			c.decreased = now
+		}
+	case utilized:
+		c.limit = math.Min(float64(c.config.MaxLimit), c.limit+1/c.limit)
+	}
+
+	for c.queue.Len() > 0 && c.inFlight < int(c.limit) {
+		w := heap.Pop(&c.queue).(*waiter)
+		c.inFlight++
+		w.ready <- true
+	}
+}
+
+// baseline is the lowest latency of the current and previous windows
+func (c *ConcurrencyLimiter) baseline() time.Duration {
+	if c.prevMin == 0 || (c.minLatency != 0 && c.minLatency < c.prevMin) {
+		return c.minLatency
+	}
+	return c.prevMin
+}
+
+// retryAfter estimates when capacity frees, in whole seconds
+func (c *ConcurrencyLimiter) retryAfter() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int(math.Max(1, math.Ceil(c.latency.Seconds())))
+}
+
+// Middleware admits requests within the limit and sheds the rest with 503.
+// Server errors and timed out requests count as failures and lower the limit.
+func (c *ConcurrencyLimiter) Middleware() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			release, ok := c.Acquire(r.Context(), c.config.Priority(r))
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(c.retryAfter()))
+				(w).WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			defer func() {
+				release(recorder.status >= http.StatusInternalServerError || r.Context().Err() != nil)
+			}()
+
+			// continue
+			h.ServeHTTP(recorder, r)
+		})
+	}
+}
+
+// statusRecorder keeps the response status for the limiter
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// waiter is a request queued for capacity
+type waiter struct {
+	priority Priority
+	sequence uint64
+	index    int
+	ready    chan bool
+}
+
+// waitQueue orders waiters by priority, then arrival
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].sequence < q[j].sequence
+}
+
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *waitQueue) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *waitQueue) Pop() any {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+// lowest returns the latest waiter of the lowest priority
+func (q waitQueue) lowest() *waiter {
+	var lowest *waiter
+	for _, w := range q {
+		if lowest == nil || w.priority > lowest.priority || (w.priority == lowest.priority && w.sequence > lowest.sequence) {
+			lowest = w
+		}
+	}
+	return lowest
+}
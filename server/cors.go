@@ -0,0 +1,206 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCORSHeaders are the request headers allowed when a policy lists none
+var defaultCORSHeaders = []string{"Accept", "Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-JWT", "Authorization", "request-id"}
+
+// defaultCORSMethods are the methods allowed when a route declares none
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// CORSPolicy configures cross-origin resource sharing
+type CORSPolicy struct {
+	// AllowedOrigins are exact origins such as "https://app.example.com",
+	// wildcard subdomains such as "https://*.example.com", or "*"
+	AllowedOrigins []string
+	// AllowedHeaders are the request headers clients may send
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers readable by clients
+	ExposedHeaders []string
+	// AllowCredentials lets browsers send cookies and authorization headers
+	AllowCredentials bool
+	// MaxAge is how long preflight responses may be cached
+	MaxAge time.Duration
+}
+
+// CORS handles cross-origin requests for a route serving methods. Preflight
+// requests are answered with the route methods, and rejected from origins
+// outside the policy. Other requests from those origins are served without
+// CORS headers, so browsers do not expose the response.
+func CORS(policy CORSPolicy, methods ...string) Middleware {
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	headers := policy.AllowedHeaders
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(headers, ", ")
+	exposeHeaders := strings.Join(policy.ExposedHeaders, ", ")
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				// same-origin or non-browser request
+				h.ServeHTTP(w, r)
+				return
+			}
+			requestMethod := r.Header.Get("Access-Control-Request-Method")
+			preflight := r.Method == http.MethodOptions && requestMethod != ""
+			if !policy.allowsOrigin(origin) {
+				if preflight {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+
+				// continue
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			allowOrigin := origin
+			if !policy.AllowCredentials && policy.allowsAnyOrigin() {
+				allowOrigin = "*"
+			}
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			if policy.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if !preflight {
+				if exposeHeaders != "" {
+					w.Header().Set("Access-Control-Expose-Headers", exposeHeaders)
+				}
+
+				// continue
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			// preflight request
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			if !containsFold(methods, requestMethod) {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+				header = strings.TrimSpace(header)
+				if header != "" && !containsFold(headers, header) {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+			}
+			w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+			if policy.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// allowsOrigin matches the origin against the exact and wildcard origins
+func (p CORSPolicy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.AllowedOrigins {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		// https://*.example.com matches subdomains but not example.com itself
+		if scheme, domain, ok := strings.Cut(allowed, "://*."); ok {
+			prefix := scheme + "://"
+			if strings.HasPrefix(origin, prefix) {
+				host := strings.TrimPrefix(origin, prefix)
+				if strings.HasSuffix(host, "."+domain) && !strings.Contains(strings.TrimSuffix(host, "."+domain), "/") {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (p CORSPolicy) allowsAnyOrigin() bool {
+	for _, allowed := range p.AllowedOrigins {
+		if strings.TrimSpace(allowed) == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteGroup registers routes sharing a path prefix, middleware and CORS policy
+type RouteGroup struct {
+	mux        *http.ServeMux
+	prefix     string
+	policy     *CORSPolicy
+	middleware []Middleware
+}
+
+// Group creates a route group under prefix. CORS is applied before the other
+// middleware, so preflight requests are answered without authentication.
+func (s *Server) Group(prefix string, policy *CORSPolicy, m ...Middleware) *RouteGroup {
+	if s.Mux == nil {
+		s.Mux = http.NewServeMux()
+	}
+	return &RouteGroup{
+		mux:        s.Mux,
+		prefix:     strings.TrimSuffix(prefix, "/"),
+		policy:     policy,
+		middleware: m,
+	}
+}
+
+// Handle registers the handler for the methods it serves on pattern
+func (g *RouteGroup) Handle(pattern string, methods []string, h http.Handler, m ...Middleware) {
+	chain := make([]Middleware, 0, len(g.middleware)+len(m)+1)
+	if g.policy != nil {
+		chain = append(chain, CORS(*g.policy, methods...))
+	}
+	chain = append(chain, allowMethods(methods))
+	chain = append(chain, g.middleware...)
+	chain = append(chain, m...)
+	g.mux.Handle(g.prefix+pattern, Use(h, chain...))
+}
+
+// allowMethods rejects methods the route does not serve
+func allowMethods(methods []string) Middleware {
+	allow := strings.Join(append(append([]string(nil), methods...), http.MethodOptions), ", ")
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Allow", allow)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if len(methods) > 0 && !containsFold(methods, r.Method) {
+				w.Header().Set("Allow", allow)
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+
+			// continue
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSAllowsOrigin(t *testing.T) {
+	policy := CORSPolicy{AllowedOrigins: []string{"https://app.example.com", " https://*.example.org "}}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://APP.EXAMPLE.COM", true},
+		{"http://app.example.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://evil-app.example.com", false},
+		{"https://api.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"http://api.example.org", false},
+		{"https://evil.com/.example.org", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		if got := policy.allowsOrigin(tt.origin); got != tt.want {
+			t.Errorf("allowsOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+
+	wildcard := CORSPolicy{AllowedOrigins: []string{"*"}}
+	if !wildcard.allowsOrigin("https://anything.test") {
+		t.Error("* does not allow every origin")
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	policy := CORSPolicy{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowCredentials: true,
+		ExposedHeaders:   []string{"X-Total"},
+	}
+	handler := Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}), CORS(policy, http.MethodGet, http.MethodPut))
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   string
+		headers     string
+		wantStatus  int
+		allowOrigin string
+	}{
+		{"same origin", http.MethodGet, "", "", "", http.StatusTeapot, ""},
+		{"allowed origin", http.MethodGet, "https://app.example.com", "", "", http.StatusTeapot, "https://app.example.com"},
+		{"disallowed origin is served without headers", http.MethodGet, "https://evil.com", "", "", http.StatusTeapot, ""},
+		{"preflight", http.MethodOptions, "https://app.example.com", http.MethodPut, "content-type", http.StatusNoContent, "https://app.example.com"},
+		{"preflight of disallowed origin", http.MethodOptions, "https://evil.com", http.MethodPut, "", http.StatusForbidden, ""},
+		{"preflight of other method", http.MethodOptions, "https://app.example.com", http.MethodDelete, "", http.StatusMethodNotAllowed, "https://app.example.com"},
+		{"preflight of other header", http.MethodOptions, "https://app.example.com", http.MethodPut, "X-Secret", http.StatusForbidden, "https://app.example.com"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/orders", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.preflight != "" {
+			r.Header.Set("Access-Control-Request-Method", tt.preflight)
+		}
+		if tt.headers != "" {
+			r.Header.Set("Access-Control-Request-Headers", tt.headers)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+			t.Errorf("%s: Access-Control-Allow-Origin %q, want %q", tt.name, got, tt.allowOrigin)
+		}
+		if tt.allowOrigin == "" && w.Header().Get("Access-Control-Allow-Credentials") != "" {
+			t.Errorf("%s: credentials allowed", tt.name)
+		}
+	}
+}
+
+func TestCORSWildcardWithoutCredentials(t *testing.T) {
+	handler := Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), CORS(CORSPolicy{AllowedOrigins: []string{"*"}}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin %q, want *", got)
+	}
+}
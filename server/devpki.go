@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// devValidity is the lifetime of generated development certificates
+	devValidity   = 365 * 24 * time.Hour
+	devEnvComment = "# development key material, do not use in production"
+)
+
+// DevPKI holds development key material, PEM encoded
+type DevPKI struct {
+	RootCA            []byte
+	ServerCert        []byte
+	ServerKey         []byte
+	PayloadPrivate    []byte
+	PayloadPublic     []byte
+	ClientPrivate     []byte
+	ClientPublic      []byte
+	DatabaseCert      []byte
+	DatabaseKey       []byte
+	DatabaseClient    []byte
+	DatabaseClientKey []byte
+}
+
+// GenerateDevPKI creates a self-signed CA, a server certificate for hosts, RSA
+// payload key pairs for the server and a client, and postgres server and client
+// certificates signed by the same CA. It must only be used for development.
+func GenerateDevPKI(hosts []string, databaseHost, databaseUser string) (*DevPKI, error) {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost"}
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "gf-sframe development root-ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	caCert, caPEM, err := signCertificate(caTemplate, caKey, nil, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pki := &DevPKI{RootCA: caPEM}
+	pki.ServerCert, pki.ServerKey, err = issueCertificate(hosts, hosts[0], x509.ExtKeyUsageServerAuth, caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+	pki.DatabaseCert, pki.DatabaseKey, err = issueCertificate([]string{databaseHost}, databaseHost, x509.ExtKeyUsageServerAuth, caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+	// postgres maps the client certificate common name to the database user
+	pki.DatabaseClient, pki.DatabaseClientKey, err = issueCertificate(nil, databaseUser, x509.ExtKeyUsageClientAuth, caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pki.PayloadPrivate, pki.PayloadPublic, err = generatePayloadKeys()
+	if err != nil {
+		return nil, err
+	}
+	pki.ClientPrivate, pki.ClientPublic, err = generatePayloadKeys()
+	if err != nil {
+		return nil, err
+	}
+	return pki, nil
+}
+
+// Env returns the key material base64 encoded under the env names read by
+// the server, GetServerPKI and pki
+func (p *DevPKI) Env() map[string]string {
+	encode := base64.StdEncoding.EncodeToString
+	return map[string]string{
+		"DEV_ROOT_CA":          encode(p.RootCA),
+		"API_SSL_CERT":         encode(p.ServerCert),
+		"API_SSL_KEY":          encode(p.ServerKey),
+		"API_PRIVATE_KEY":      encode(p.PayloadPrivate),
+		"API_PUBLIC_KEY":       encode(p.PayloadPublic),
+		"CLIENT_PUBLICKEY":     encode(p.ClientPublic),
+		"CLIENT_PRIVATEKEY":    encode(p.ClientPrivate),
+		"DB_ROOT_CA":           encode(p.RootCA),
+		"DB_SSL_CERT":          encode(p.DatabaseClient),
+		"DB_SSL_KEY":           encode(p.DatabaseClientKey),
+		"POSTGRES_SSL_CERT":    encode(p.DatabaseCert),
+		"POSTGRES_SSL_KEY":     encode(p.DatabaseKey),
+		"POSTGRES_SSL_ROOT_CA": encode(p.RootCA),
+	}
+}
+
+// WriteEnv stores the key material in the env file at path, replacing
+// existing values and keeping every other line
+func (p *DevPKI) WriteEnv(path string) error {
+	values := p.Env()
+	var lines []string
+	if content, err := os.ReadFile(filepath.Clean(path)); err == nil {
+		scanner := bufio.NewScanner(strings.NewReader(string(content)))
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			name, _, _ := strings.Cut(line, "=")
+			if _, ok := values[strings.TrimSpace(name)]; !ok && line != devEnvComment {
+				lines = append(lines, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines = append(lines, devEnvComment)
+	for _, name := range names {
+		lines = append(lines, name+"="+values[name])
+	}
+	return os.WriteFile(filepath.Clean(path), []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// initDevPKI generates ephemeral server certificates and payload keys in
+// development when DEV_PKI=1 and none are configured, the CA certificate is
+// written to DEV_PKI_CA_FILE so clients can trust it
+func initDevPKI(logger *logrus.Logger) {
+	if os.Getenv("DEV_PKI") != "1" {
+		return
+	}
+	if os.Getenv("API_SSL_CERT") != "" || os.Getenv("API_SSL_CERT_FILE") != "" || os.Getenv("API_PRIVATE_KEY") != "" {
+		return
+	}
+
+	logger.Info("Generating ephemeral development certificates")
+	pki, err := GenerateDevPKI([]string{"localhost", "127.0.0.1", "::1"}, "localhost", os.Getenv("DB_USER"))
+	if err != nil {
+		logger.Fatal(err)
+	}
+	caFile := os.Getenv("DEV_PKI_CA_FILE")
+	if caFile == "" {
+		caFile = "./dev-ca.crt"
+	}
+	if err := os.WriteFile(filepath.Clean(caFile), pki.RootCA, 0600); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Info("Development CA certificate written to " + caFile)
+
+	env := pki.Env()
+	for _, name := range []string{"API_SSL_CERT", "API_SSL_KEY", "API_PRIVATE_KEY", "API_PUBLIC_KEY"} {
+		if err := os.Setenv(name, env[name]); err != nil {
+			logger.Fatal(err)
+		}
+	}
+}
+
+// issueCertificate creates a P-384 key and a certificate signed by the CA
+func issueCertificate(hosts []string, commonName string, usage x509.ExtKeyUsage, caCert *x509.Certificate, caKey crypto.Signer) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	_, certPEM, err := signCertificate(template, key, caCert, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// signCertificate signs the template, self-signed when parent is nil
+func signCertificate(template *x509.Certificate, key *ecdsa.PrivateKey, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, []byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(devValidity)
+	if parent == nil {
+		parent = template
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// generatePayloadKeys creates an RSA key pair in the PKCS1 private and PKIX
+// public formats read by GetServerPKI
+func generatePayloadKeys() ([]byte, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}),
+		nil
+}
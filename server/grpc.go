@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// grpcPublicPrefixes are served without authentication
+var grpcPublicPrefixes = []string{
+	"/grpc.health.v1.Health/",
+}
+
+// initGRPC creates the gRPC server when GRPC_ENABLED is set. The server is
+// hosted on GRPC_PORT, or next to HTTP on SERVER_PORT when none is given.
+// Reflection is served to authenticated callers in dev or with GRPC_REFLECTION.
+func initGRPC(s *Server) {
+	enabled, _ := strconv.ParseBool(os.Getenv("GRPC_ENABLED"))
+	if !enabled {
+		return
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(s.unaryInterceptor),
+		grpc.ChainStreamInterceptor(s.streamInterceptor),
+	}
+	// on a shared port TLS is terminated by the http server
+	port := os.Getenv("GRPC_PORT")
+	if s.TLSConfig != nil && port != "" && port != os.Getenv("SERVER_PORT") {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.TLSConfig)))
+	}
+
+	s.GRPC = grpc.NewServer(opts...)
+	s.grpcHealth = health.NewServer()
+	healthpb.RegisterHealthServer(s.GRPC, s.grpcHealth)
+	if reflect, _ := strconv.ParseBool(os.Getenv("GRPC_REFLECTION")); reflect || s.Env == "dev" {
+		reflection.Register(s.GRPC)
+	}
+}
+
+// GRPCPublicMethod serves the full gRPC method names without authentication
+func (s *Server) GRPCPublicMethod(methods ...string) {
+	if s.grpcPublic == nil {
+		s.grpcPublic = make(map[string]bool)
+	}
+	for _, method := range methods {
+		s.grpcPublic[method] = true
+	}
+}
+
+// unaryInterceptor applies throttling, authentication and access logging
+func (s *Server) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx, err := s.grpcGuard(ctx, info.FullMethod)
+	var resp interface{}
+	if err == nil {
+		resp, err = handler(ctx, req)
+	}
+	s.grpcLog(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+// streamInterceptor applies throttling, authentication and access logging
+func (s *Server) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, err := s.grpcGuard(ss.Context(), info.FullMethod)
+	if err == nil {
+		err = handler(srv, &guardedStream{ServerStream: ss, ctx: ctx})
+	}
+	s.grpcLog(ctx, info.FullMethod, start, err)
+	return err
+}
+
+// grpcGuard mirrors the IsThrottle, IsAuthenticated and IsAuthorized middleware
+func (s *Server) grpcGuard(ctx context.Context, method string) (context.Context, error) {
+	if Limiter.IsThrottled(grpcPeerIP(ctx)) {
+		return ctx, status.Error(codes.ResourceExhausted, "too many requests")
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			ctx = context.WithValue(ctx, clientIdentityKey, newClientIdentity(info.State.VerifiedChains[0][0]))
+		}
+	}
+
+	for _, prefix := range grpcPublicPrefixes {
+		if strings.HasPrefix(method, prefix) {
+			return ctx, nil
+		}
+	}
+	if s.grpcPublic[method] {
+		return ctx, nil
+	}
+
+	// the JWT implementations read http requests, so metadata is presented as headers
+	token, err := authenticate(grpcRequest(ctx, method), s.JWT, s.sessions()...)
+	if err != nil {
+		return ctx, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	missing, allowed, err := currentRoles().Authorize(ctx, token, http.MethodPost, method)
+	if err != nil {
+		return ctx, status.Error(codes.Unavailable, "permissions unavailable")
+	}
+	if !allowed {
+		return ctx, status.Error(codes.PermissionDenied, "missing permission "+missing)
+	}
+	return context.WithValue(ctx, tokenKey, token), nil
+}
+
+// grpcLog writes the access log entry of a call
+func (s *Server) grpcLog(ctx context.Context, method string, start time.Time, err error) {
+	s.Logger.WithFields(logrus.Fields{
+		"method":   method,
+		"code":     status.Code(err).String(),
+		"duration": time.Since(start).String(),
+		"ip":       grpcPeerIP(ctx),
+	}).Info("gRPC request")
+}
+
+// guardedStream carries the authenticated context into stream handlers
+type guardedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the authenticated context
+func (g *guardedStream) Context() context.Context {
+	return g.ctx
+}
+
+// grpcRequest builds an http request out of the incoming metadata
+func grpcRequest(ctx context.Context, method string) *http.Request {
+	r := &http.Request{
+		Method:     http.MethodPost,
+		URL:        &url.URL{Path: method},
+		Header:     make(http.Header),
+		RemoteAddr: grpcPeerAddr(ctx),
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+	return r.WithContext(ctx)
+}
+
+func grpcPeerAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// grpcPeerIP resolves the client address through trusted proxies
+func grpcPeerIP(ctx context.Context) string {
+	return Resolver.Resolve(grpcRequest(ctx, ""))
+}
+
+// grpcHandler routes gRPC calls arriving on the http port to the gRPC server
+func grpcHandler(grpcServer *grpc.Server, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpcServer.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// contextKey scopes values stored in contexts by the server
+type contextKey string
+
+const tokenKey contextKey = "token"
+
+// TokenFromContext returns the token authenticated for the call
+func TokenFromContext(ctx context.Context) (*TokenInfo, bool) {
+	token, ok := ctx.Value(tokenKey).(*TokenInfo)
+	return token, ok
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/greatfocus/gf-sframe/database"
+	"github.com/sirupsen/logrus"
+)
+
+// IPRuleSchema creates the table read by DatabaseIPList
+const IPRuleSchema = `
+CREATE TABLE IF NOT EXISTS ip_rules (
+	id SERIAL PRIMARY KEY,
+	policy TEXT NOT NULL,
+	action TEXT NOT NULL CHECK (action IN ('allow', 'deny')),
+	cidr TEXT NOT NULL,
+	description TEXT
+);
+CREATE INDEX IF NOT EXISTS ip_rules_policy ON ip_rules (policy);`
+
+// Precedence decides between an address matching both lists
+type Precedence int
+
+const (
+	// DenyFirst rejects addresses on the deny list even when allowed
+	DenyFirst Precedence = iota
+	// AllowFirst accepts allowed addresses even when denied, for exceptions
+	// inside denied ranges
+	AllowFirst
+)
+
+// IPLists are allow and deny entries, single addresses or CIDR ranges
+type IPLists struct {
+	Allow []string
+	Deny  []string
+}
+
+// IPListSource loads the lists of a filter
+type IPListSource func(ctx context.Context) (IPLists, error)
+
+// IPFilter allows or denies clients by address and CIDR range. When the allow
+// list is empty every address not denied is allowed.
+type IPFilter struct {
+	Name       string
+	Precedence Precedence
+	source     IPListSource
+	logger     *logrus.Logger
+	mu         sync.RWMutex
+	allow      []ipRule
+	deny       []ipRule
+}
+
+type ipRule struct {
+	prefix netip.Prefix
+	raw    string
+}
+
+// NewIPFilter creates a filter and loads its lists
+func NewIPFilter(name string, source IPListSource, logger *logrus.Logger) (*IPFilter, error) {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	f := &IPFilter{
+		Name:   name,
+		source: source,
+		logger: logger,
+	}
+	if err := f.Reload(context.Background()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload replaces the lists with the current source content, the previous
+// lists are kept when the source fails or holds invalid entries
+func (f *IPFilter) Reload(ctx context.Context) error {
+	lists, err := f.source(ctx)
+	if err != nil {
+		return err
+	}
+	allow, err := parseIPRules(lists.Allow)
+	if err != nil {
+		return err
+	}
+	deny, err := parseIPRules(lists.Deny)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.allow = allow
+	f.deny = deny
+	f.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the lists periodically until the context is cancelled
+func (f *IPFilter) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := f.Reload(ctx); err != nil {
+				f.logger.Error("Reloading ip filter " + f.Name + " failed, because of " + err.Error())
+			}
+		}
+	}
+}
+
+// Check reports whether the address is allowed and the rule that decided it
+func (f *IPFilter) Check(address string) (bool, string) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return false, "invalid address"
+	}
+	addr = addr.Unmap()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	allowRule, allowed := matchIPRule(f.allow, addr)
+	denyRule, denied := matchIPRule(f.deny, addr)
+
+	switch {
+	case allowed && (!denied || f.Precedence == AllowFirst):
+		return true, "allow " + allowRule
+	case denied:
+		return false, "deny " + denyRule
+	case len(f.allow) > 0:
+		return false, "not in allow list"
+	}
+	return true, ""
+}
+
+// Middleware rejects requests from addresses the filter does not allow
+func (f *IPFilter) Middleware() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := ip(r)
+			if allowed, rule := f.Check(client); !allowed {
+				f.logger.WithFields(logrus.Fields{
+					"filter": f.Name,
+					"ip":     client,
+					"rule":   rule,
+					"path":   r.URL.Path,
+				}).Warn("Request rejected by ip filter")
+				(w).WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			// continue
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// StaticIPList returns fixed lists
+func StaticIPList(lists IPLists) IPListSource {
+	return func(context.Context) (IPLists, error) {
+		return lists, nil
+	}
+}
+
+// EnvIPList reads comma separated lists from the allow and deny env variables
+func EnvIPList(allowVar, denyVar string) IPListSource {
+	return func(context.Context) (IPLists, error) {
+		return IPLists{
+			Allow: splitList(os.Getenv(allowVar)),
+			Deny:  splitList(os.Getenv(denyVar)),
+		}, nil
+	}
+}
+
+// FileIPList reads a file of "allow <cidr>" and "deny <cidr>" lines, lines
+// starting with # are comments
+func FileIPList(path string) IPListSource {
+	return func(context.Context) (IPLists, error) {
+		lists := IPLists{}
+		file, err := os.Open(filepath.Clean(path))
+		if err != nil {
+			return lists, err
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			action, value, ok := strings.Cut(line, " ")
+			if !ok {
+				return lists, errors.New("invalid ip rule " + line)
+			}
+			lists, err = appendIPRule(lists, action, strings.TrimSpace(value))
+			if err != nil {
+				return lists, err
+			}
+		}
+		return lists, scanner.Err()
+	}
+}
+
+// DatabaseIPList reads the rules of a policy from the ip_rules table
+func DatabaseIPList(db database.Database, policy string) IPListSource {
+	return func(ctx context.Context) (IPLists, error) {
+		lists := IPLists{}
+		rows, err := db.Query(ctx, "SELECT action, cidr FROM ip_rules WHERE policy = $1", policy)
+		if err != nil {
+			return lists, err
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
+		for rows.Next() {
+			var action, cidr string
+			if err := rows.Scan(&action, &cidr); err != nil {
+				return lists, err
+			}
+			lists, err = appendIPRule(lists, action, cidr)
+			if err != nil {
+				return lists, err
+			}
+		}
+		return lists, rows.Err()
+	}
+}
+
+func appendIPRule(lists IPLists, action, value string) (IPLists, error) {
+	switch strings.ToLower(action) {
+	case "allow":
+		lists.Allow = append(lists.Allow, value)
+	case "deny":
+		lists.Deny = append(lists.Deny, value)
+	default:
+		return lists, errors.New("invalid ip rule action " + action)
+	}
+	return lists, nil
+}
+
+func parseIPRules(values []string) ([]ipRule, error) {
+	rules := make([]ipRule, 0, len(values))
+	for _, value := range values {
+		prefix, err := parsePrefix(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, ipRule{prefix: prefix, raw: value})
+	}
+	return rules, nil
+}
+
+func matchIPRule(rules []ipRule, addr netip.Addr) (string, bool) {
+	for _, rule := range rules {
+		if rule.prefix.Contains(addr) {
+			return rule.raw, true
+		}
+	}
+	return "", false
+}
+
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// allowListFilter creates a filter allowing only the entries of the list.
+// Invalid entries match no address and an empty list allows no address.
+func allowListFilter(name, list string) *IPFilter {
+	f := &IPFilter{Name: name, logger: logrus.StandardLogger()}
+	for _, entry := range splitList(list) {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			f.logger.Error("Ignoring allowed ip " + entry + ", because of " + err.Error())
+			continue
+		}
+		f.allow = append(f.allow, ipRule{prefix: prefix, raw: entry})
+	}
+	if len(f.allow) == 0 {
+		f.deny = []ipRule{
+			{prefix: netip.MustParsePrefix("0.0.0.0/0"), raw: "empty allow list"},
+			{prefix: netip.MustParsePrefix("::/0"), raw: "empty allow list"},
+		}
+	}
+	return f
+}
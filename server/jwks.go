@@ -0,0 +1,375 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jwt5 "github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrCannotSign is returned by verifiers of tokens issued elsewhere
+	ErrCannotSign = errors.New("tokens are issued by the identity provider")
+	// ErrUnknownSubject is returned for tokens whose subject maps to no actor
+	ErrUnknownSubject = errors.New("token subject is not a known actor")
+)
+
+// ClaimMapping names the claims mapped into TokenInfo, nested claims use
+// dotted paths such as realm_access.roles
+type ClaimMapping struct {
+	// Subject is mapped to Subject, and to ActorID by RemoteJWTConfig.ActorID
+	Subject string
+	// Roles and Scopes are mapped to Permissions, as arrays or space
+	// separated strings
+	Roles  string
+	Scopes string
+	Origin string
+}
+
+// DefaultClaimMapping reads sub, roles and scope
+var DefaultClaimMapping = ClaimMapping{
+	Subject: "sub",
+	Roles:   "roles",
+	Scopes:  "scope",
+}
+
+// RemoteJWTConfig configures the verification of tokens of an identity provider
+type RemoteJWTConfig struct {
+	// URL of the JWKS of the identity provider
+	URL string
+	// Issuer and Audience are required, so tokens the provider issued to
+	// other clients are rejected
+	Issuer   string
+	Audience string
+	// ActorID maps the subject to the actor id, numeric subjects are the
+	// actor id by default. Tokens whose subject maps to no actor are rejected,
+	// since sessions, throttles and permissions are kept by actor.
+	ActorID func(ctx context.Context, subject string) (int64, error)
+	// Leeway is the clock skew allowed when checking exp and nbf
+	Leeway time.Duration
+	// Algorithms accepted, RS256, ES256 and EdDSA by default
+	Algorithms []string
+	// RefreshInterval is how often the keys are fetched in the background
+	RefreshInterval time.Duration
+	// MinRefetch limits fetches for tokens signed by an unknown kid
+	MinRefetch time.Duration
+	Claims     ClaimMapping
+	Client     *http.Client
+	Logger     *logrus.Logger
+}
+
+// remoteJWT verifies tokens with the public keys of a remote JWKS
+type remoteJWT struct {
+	config    RemoteJWTConfig
+	fetching  sync.Mutex
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewRemoteJWT creates a verifier of tokens issued by an identity provider.
+// Keys are fetched now, refreshed in the background, and refetched when a
+// token names an unknown kid.
+func NewRemoteJWT(config RemoteJWTConfig) (JWT, error) {
+	if config.URL == "" {
+		return nil, errors.New("missing JWKS url")
+	}
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, errors.New("missing JWKS issuer or audience")
+	}
+	if config.ActorID == nil {
+		config.ActorID = numericActorID
+	}
+	if config.Leeway <= 0 {
+		config.Leeway = time.Minute
+	}
+	if len(config.Algorithms) == 0 {
+		config.Algorithms = []string{jwt5.SigningMethodRS256.Alg(), jwt5.SigningMethodES256.Alg(), jwt5.SigningMethodEdDSA.Alg()}
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = 15 * time.Minute
+	}
+	if config.MinRefetch <= 0 {
+		config.MinRefetch = 10 * time.Second
+	}
+	if config.Claims == (ClaimMapping{}) {
+		config.Claims = DefaultClaimMapping
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if config.Logger == nil {
+		config.Logger = logrus.StandardLogger()
+	}
+
+	j := &remoteJWT{config: config}
+	if err := j.refresh(); err != nil {
+		// the keys are fetched again for the first token
+		config.Logger.Error("Fetching JWKS failed, because of " + err.Error())
+	}
+	go j.refreshEvery(config.RefreshInterval)
+	return j, nil
+}
+
+// CreateToken is not supported, tokens are issued by the identity provider
+func (j *remoteJWT) CreateToken(tokenInfo TokenInfo) (string, error) {
+	return "", ErrCannotSign
+}
+
+// IsValidToken checks for jwt validity
+func (j *remoteJWT) IsValidToken(r *http.Request) bool {
+	_, err := j.GetTokenInfo(r)
+	return err == nil
+}
+
+// GetTokenInfo verifies the token and maps its claims
+func (j *remoteJWT) GetTokenInfo(r *http.Request) (*TokenInfo, error) {
+	options := []jwt5.ParserOption{
+		jwt5.WithValidMethods(j.config.Algorithms),
+		jwt5.WithLeeway(j.config.Leeway),
+		jwt5.WithIssuer(j.config.Issuer),
+		jwt5.WithAudience(j.config.Audience),
+	}
+	token, err := jwt5.Parse(getToken(r), func(token *jwt5.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return j.key(kid)
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := token.Claims.(jwt5.MapClaims)
+	if _, err := claims.GetExpirationTime(); err != nil || claims["exp"] == nil {
+		return nil, errors.New("token has no expiry")
+	}
+	return j.tokenInfo(r.Context(), claims)
+}
+
+// tokenInfo maps the configured claims into TokenInfo
+func (j *remoteJWT) tokenInfo(ctx context.Context, claims jwt5.MapClaims) (*TokenInfo, error) {
+	mapping := j.config.Claims
+	info := &TokenInfo{}
+	info.Subject, _ = claimValue(claims, mapping.Subject).(string)
+	actorID, err := j.config.ActorID(ctx, info.Subject)
+	if err != nil || actorID == 0 {
+		return nil, ErrUnknownSubject
+	}
+	info.ActorID = actorID
+	if origin, ok := claimValue(claims, mapping.Origin).(string); ok {
+		info.Origin = origin
+	}
+	info.Permissions = append(claimStrings(claimValue(claims, mapping.Roles)), claimStrings(claimValue(claims, mapping.Scopes))...)
+	return info, nil
+}
+
+// numericActorID maps numeric subjects to the actor id
+func numericActorID(_ context.Context, subject string) (int64, error) {
+	return strconv.ParseInt(subject, 10, 64)
+}
+
+// key returns the public key of kid, refetching the keys once when unknown
+func (j *remoteJWT) key(kid string) (crypto.PublicKey, error) {
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+
+	j.fetching.Lock()
+	defer j.fetching.Unlock()
+	// another request may have fetched the keys meanwhile
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+	j.mu.RLock()
+	recent := time.Since(j.fetchedAt) < j.config.MinRefetch
+	j.mu.RUnlock()
+	if recent {
+		return nil, ErrUnknownKey
+	}
+	if err := j.fetch(); err != nil {
+		return nil, err
+	}
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// lookup finds kid, a token without kid matches a single key
+func (j *remoteJWT) lookup(kid string) (crypto.PublicKey, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+func (j *remoteJWT) refreshEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := j.refresh(); err != nil {
+			j.config.Logger.Error("Refreshing JWKS failed, because of " + err.Error())
+		}
+	}
+}
+
+func (j *remoteJWT) refresh() error {
+	j.fetching.Lock()
+	defer j.fetching.Unlock()
+	return j.fetch()
+}
+
+// fetch replaces the keys with the remote key set, the previous keys are
+// kept when the fetch fails or yields no usable key
+func (j *remoteJWT) fetch() error {
+	j.mu.Lock()
+	j.fetchedAt = time.Now()
+	j.mu.Unlock()
+
+	res, err := j.config.Client.Get(j.config.URL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusOK {
+		return errors.New("JWKS responded with " + res.Status)
+	}
+
+	var set JWKSet
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&set); err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			j.config.Logger.Warn("Skipping JWKS key " + jwk.Kid + ", because of " + err.Error())
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS has no usable signing keys")
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+	return nil
+}
+
+// PublicKey decodes the RSA, EC or Ed25519 public key
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 || exponent.Int64() < 3 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve " + k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC point")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errors.New("unsupported curve " + k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("unsupported key type " + k.Kty)
+}
+
+// claimValue returns the claim at a dotted path
+func claimValue(claims jwt5.MapClaims, path string) interface{} {
+	if path == "" {
+		return nil
+	}
+	var value interface{} = map[string]interface{}(claims)
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// claimStrings reads an array of strings or a space separated string
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
@@ -1,91 +1,258 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	jwt5 "github.com/golang-jwt/jwt/v5"
 )
 
-// JWT
-type JWT interface {
-	CreateToken(tokenInfo TokenInfo) (string, error)
+// ErrOriginMismatch is returned for tokens presented from another origin than
+// the one they were issued for
+var ErrOriginMismatch = errors.New("token origin mismatch")
+
+// TypedJWT issues and verifies tokens carrying the custom claims C next to
+// the registered claims
+type TypedJWT[C any] interface {
+	CreateToken(claims C) (string, error)
 	IsValidToken(r *http.Request) bool
-	GetTokenInfo(r *http.Request) (*TokenInfo, error)
-	Secret() string
+	GetTokenInfo(r *http.Request) (*C, error)
 }
 
+// JWT issues and verifies tokens carrying TokenInfo
+type JWT = TypedJWT[TokenInfo]
+
 // TokenInfo struct
 type TokenInfo struct {
-	Permissions []string
-	Origin      string
-	ActorID     int64
+	Permissions []string `json:"permissions,omitempty"`
+	Origin      string   `json:"origin,omitempty"`
+	ActorID     int64    `json:"actorId,omitempty"`
+	SessionID   string   `json:"sid,omitempty"`
+	// Subject is carried by the sub claim
+	Subject string `json:"-"`
+	// APIKey is the id of the key authenticating the request, its scopes
+	// are not extended by Roles.Provider
+	APIKey string `json:"-"`
 }
 
-// jwt struct
-type jwt struct {
-	authorized bool
-	minutes    int64
-	secret     string
+// TokenSubject returns the sub claim, the actor id when no subject is set
+func (t TokenInfo) TokenSubject() string {
+	if t.Subject != "" || t.ActorID == 0 {
+		return t.Subject
+	}
+	return strconv.FormatInt(t.ActorID, 10)
 }
 
-// NewJWT
-func NewJWT(secret string, minutes int64, authorized bool) JWT {
-	return &jwt{
-		minutes:    minutes,
-		authorized: authorized,
-		secret:     secret,
+// SetTokenSubject reads the sub claim, numeric subjects are the actor id
+func (t *TokenInfo) SetTokenSubject(subject string) {
+	t.Subject = subject
+	if actorID, err := strconv.ParseInt(subject, 10, 64); err == nil && t.ActorID == 0 {
+		t.ActorID = actorID
+	}
+}
+
+// TokenOrigin returns the origin the token is bound to
+func (t TokenInfo) TokenOrigin() string {
+	return t.Origin
+}
+
+// JWTConfig configures the registered claims and the signing key of tokens
+type JWTConfig struct {
+	// Issuer is set as iss and required when verifying, when not empty
+	Issuer string
+	// Audience is set as aud, verifying requires the first audience
+	Audience []string
+	// Lifetime sets exp, 15 minutes by default
+	Lifetime time.Duration
+	// NotBefore delays nbf after iat
+	NotBefore time.Duration
+	// Leeway is the clock skew allowed when checking exp, nbf and iat
+	Leeway time.Duration
+	// Keyring signs with asymmetric keys, Secret signs with HS256 otherwise
+	Keyring *Keyring
+	Secret  string
+}
+
+// typedJWT issues tokens with registered claims and the custom claims C
+type typedJWT[C any] struct {
+	config JWTConfig
+}
+
+// NewTypedJWT creates tokens with the registered claims of config and custom
+// claims C. C may implement TokenSubject() string to set sub, and its pointer
+// SetTokenSubject(string) to read it back. Custom claims must not use the
+// names of registered claims.
+func NewTypedJWT[C any](config JWTConfig) (TypedJWT[C], error) {
+	if config.Keyring == nil && config.Secret == "" {
+		return nil, errors.New("missing JWT signing key")
 	}
+	if config.Lifetime <= 0 {
+		config.Lifetime = 15 * time.Minute
+	}
+	return &typedJWT[C]{config: config}, nil
+}
+
+// NewJWT creates HS256 tokens carrying TokenInfo, valid for minutes.
+//
+// Deprecated: authorized is ignored, tokens carry the permissions of TokenInfo
+// and routes check them with IsAuthorized.
+func NewJWT(secret string, minutes int64, authorized bool) JWT {
+	return &typedJWT[TokenInfo]{config: JWTConfig{
+		Secret:   secret,
+		Lifetime: time.Duration(minutes) * time.Minute,
+	}}
+}
+
+// NewKeyringJWT creates tokens signed with RS256, ES256 or EdDSA keys of the
+// keyring, which other services verify with its published public keys.
+//
+// Deprecated: authorized is ignored, tokens carry the permissions of TokenInfo
+// and routes check them with IsAuthorized.
+func NewKeyringJWT(keyring *Keyring, minutes int64, authorized bool) JWT {
+	return &typedJWT[TokenInfo]{config: JWTConfig{
+		Keyring:  keyring,
+		Lifetime: time.Duration(minutes) * time.Minute,
+	}}
+}
+
+// Keyring returns the keys signing the tokens, nil for HS256
+func (j *typedJWT[C]) Keyring() *Keyring {
+	return j.config.Keyring
 }
 
 // CreateToken generates jwt for API login
-func (j *jwt) CreateToken(tokenInfo TokenInfo) (string, error) {
-	claims := &jwt5.MapClaims{
-		"iss":  "issuer",
-		"exp":  time.Now().Add(time.Minute * time.Duration(j.minutes)).Unix(),
-		"data": tokenInfo,
-	}
-	token := jwt5.NewWithClaims(jwt5.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(j.secret))
+func (j *typedJWT[C]) CreateToken(custom C) (string, error) {
+	now := time.Now()
+	claims := &tokenClaims[C]{
+		RegisteredClaims: jwt5.RegisteredClaims{
+			Issuer:    j.config.Issuer,
+			Audience:  j.config.Audience,
+			ExpiresAt: jwt5.NewNumericDate(now.Add(j.config.Lifetime)),
+			NotBefore: jwt5.NewNumericDate(now.Add(j.config.NotBefore)),
+			IssuedAt:  jwt5.NewNumericDate(now),
+			ID:        randomHex(16),
+		},
+		Custom: custom,
+	}
+	if subject, ok := any(custom).(interface{ TokenSubject() string }); ok {
+		claims.Subject = subject.TokenSubject()
+	}
+
+	if j.config.Keyring == nil {
+		return jwt5.NewWithClaims(jwt5.SigningMethodHS256, claims).SignedString([]byte(j.config.Secret))
+	}
+	key, err := j.config.Keyring.signer()
 	if err != nil {
 		return "", err
 	}
-	return tokenString, nil
+	token := jwt5.NewWithClaims(jwt5.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Key)
+}
+
+// IsValidToken checks for jwt validity, as GetTokenInfo does
+func (j *typedJWT[C]) IsValidToken(r *http.Request) bool {
+	_, err := j.GetTokenInfo(r)
+	return err == nil
 }
 
-// IsValidToken checks for jwt validity
-func (j *jwt) IsValidToken(r *http.Request) bool {
-	tokenString := getToken(r)
-	token, err := jwt5.Parse(tokenString, func(token *jwt5.Token) (interface{}, error) {
-		return []byte(j.secret), nil
-	})
+// GetTokenInfo verifies the token of the request and returns its custom claims
+func (j *typedJWT[C]) GetTokenInfo(r *http.Request) (*C, error) {
+	claims := &tokenClaims[C]{}
+	token, err := jwt5.ParseWithClaims(getToken(r), claims, j.key, j.parserOptions()...)
 	if err != nil {
-		return false
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("token has no expiry")
+	}
+
+	custom := &claims.Custom
+	if subject, ok := any(custom).(interface{ SetTokenSubject(string) }); ok && claims.Subject != "" {
+		subject.SetTokenSubject(claims.Subject)
+	}
+	if origin, ok := any(custom).(interface{ TokenOrigin() string }); ok {
+		if bound, requested := origin.TokenOrigin(), r.Header.Get("Origin"); bound != "" && requested != "" && bound != requested {
+			return nil, ErrOriginMismatch
+		}
+	}
+	return custom, nil
+}
+
+// key returns the verification key of the token
+func (j *typedJWT[C]) key(token *jwt5.Token) (interface{}, error) {
+	if j.config.Keyring == nil {
+		return []byte(j.config.Secret), nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	return j.config.Keyring.PublicKey(kid)
+}
+
+func (j *typedJWT[C]) parserOptions() []jwt5.ParserOption {
+	method := jwt5.SigningMethodHS256.Alg()
+	if j.config.Keyring != nil {
+		method = j.config.Keyring.Algorithm()
 	}
-	claims := token.Claims.(jwt5.MapClaims)
-	data := claims["data"].(TokenInfo)
-	return r.Header.Get("Origin") != data.Origin
+	options := []jwt5.ParserOption{
+		jwt5.WithValidMethods([]string{method}),
+		jwt5.WithLeeway(j.config.Leeway),
+		jwt5.WithIssuedAt(),
+	}
+	if j.config.Issuer != "" {
+		options = append(options, jwt5.WithIssuer(j.config.Issuer))
+	}
+	if len(j.config.Audience) > 0 {
+		options = append(options, jwt5.WithAudience(j.config.Audience[0]))
+	}
+	return options
 }
 
-// GetTokenInfo returns token information
-func (j *jwt) GetTokenInfo(r *http.Request) (*TokenInfo, error) {
-	tokenString := getToken(r)
-	token, err := jwt5.Parse(tokenString, func(token *jwt5.Token) (interface{}, error) {
-		return []byte(j.secret), nil
-	})
+// tokenClaims are the registered claims and the custom claims, encoded in
+// the same JSON object
+type tokenClaims[C any] struct {
+	jwt5.RegisteredClaims
+	Custom C
+}
+
+// MarshalJSON merges the custom claims into the registered claims
+func (t tokenClaims[C]) MarshalJSON() ([]byte, error) {
+	registered, err := json.Marshal(t.RegisteredClaims)
 	if err != nil {
 		return nil, err
 	}
-
-	claims := token.Claims.(jwt5.MapClaims)
-	data := claims["data"].(TokenInfo)
-	return &data, nil
+	custom, err := json.Marshal(t.Custom)
+	if err != nil {
+		return nil, err
+	}
+	custom = bytes.TrimSpace(custom)
+	if len(custom) < 2 || custom[0] != '{' {
+		return nil, errors.New("custom claims must encode as a JSON object")
+	}
+	if string(custom) == "{}" {
+		return registered, nil
+	}
+	if string(registered) == "{}" {
+		return custom, nil
+	}
+	// {"iss":..} + {"permissions":..} => {"iss":..,"permissions":..}
+	merged := append(registered[:len(registered)-1], ',')
+	return append(merged, custom[1:]...), nil
 }
 
-// GetSecret returns secret information
-func (j *jwt) Secret() string {
-	return j.secret
+// UnmarshalJSON decodes the registered and the custom claims from the object
+func (t *tokenClaims[C]) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &t.RegisteredClaims); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &t.Custom)
 }
 
 // getToken get jwt from header
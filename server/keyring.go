@@ -0,0 +1,312 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt5 "github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// JWKSPath is where the public keys of a keyring are published
+const JWKSPath = "/.well-known/jwks.json"
+
+// retirementSkew keeps retired keys past their retention for replicas whose
+// clocks run behind
+const retirementSkew = time.Minute
+
+// ErrUnknownKey is returned for tokens signed by a key missing from the keyring
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// SigningKey is a private key identified by its kid
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	Key       crypto.Signer
+	// Expires is when a retired key stops verifying tokens, zero while active
+	Expires time.Time
+}
+
+// JWK is a public JSON web key
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is a set of public JSON web keys
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Keyring signs with its active key and verifies with the active and the
+// retiring keys, so tokens issued before a rotation stay valid until they expire
+type Keyring struct {
+	algorithm string
+	retention time.Duration
+	mu        sync.RWMutex
+	active    *SigningKey
+	retiring  []*SigningKey
+}
+
+// NewKeyring creates an empty keyring for RS256, ES256 or EdDSA. Retired keys
+// are kept for retention, which must cover the token lifetime and the leeway
+// of verifiers, and for a further minute of clock skew between replicas.
+func NewKeyring(algorithm string, retention time.Duration) (*Keyring, error) {
+	switch algorithm {
+	case jwt5.SigningMethodRS256.Alg(), jwt5.SigningMethodES256.Alg(), jwt5.SigningMethodEdDSA.Alg():
+	default:
+		return nil, errors.New("unsupported signing algorithm " + algorithm)
+	}
+	return &Keyring{algorithm: algorithm, retention: retention}, nil
+}
+
+// Algorithm returns the signing algorithm of the keyring
+func (k *Keyring) Algorithm() string {
+	return k.algorithm
+}
+
+// Add activates a private key, retiring the active key
+func (k *Keyring) Add(key crypto.Signer) error {
+	signing, err := k.signingKey(key)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.retire()
+	k.active = signing
+	return nil
+}
+
+// Retire adds a private key that only verifies tokens, until retention passes
+func (k *Keyring) Retire(key crypto.Signer) error {
+	signing, err := k.signingKey(key)
+	if err != nil {
+		return err
+	}
+	signing.Expires = time.Now().Add(k.retention + retirementSkew)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.retiring = append(k.retiring, signing)
+	return nil
+}
+
+// Rotate activates a generated key, retiring the active key
+func (k *Keyring) Rotate() error {
+	key, err := GenerateSigningKey(k.algorithm)
+	if err != nil {
+		return err
+	}
+	return k.Add(key)
+}
+
+// RotateEvery rotates the keys on a schedule, each key signs for interval
+func (k *Keyring) RotateEvery(interval time.Duration, logger *logrus.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := k.Rotate(); err != nil {
+			logger.Error("Rotating signing keys failed, because of " + err.Error())
+			continue
+		}
+		logger.Info("Rotated signing keys")
+	}
+}
+
+// retire moves the active key to the retiring keys and drops expired keys
+func (k *Keyring) retire() {
+	now := time.Now()
+	keys := k.retiring[:0]
+	for _, key := range k.retiring {
+		if now.Before(key.Expires) {
+			keys = append(keys, key)
+		}
+	}
+	if k.active != nil {
+		k.active.Expires = now.Add(k.retention + retirementSkew)
+		keys = append(keys, k.active)
+	}
+	k.retiring = keys
+}
+
+// signer returns the active key
+func (k *Keyring) signer() (*SigningKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.active == nil {
+		return nil, errors.New("no active signing key")
+	}
+	return k.active, nil
+}
+
+// PublicKey returns the verification key of kid
+func (k *Keyring) PublicKey(kid string) (crypto.PublicKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.active != nil && k.active.ID == kid {
+		return k.active.Key.Public(), nil
+	}
+	now := time.Now()
+	for _, key := range k.retiring {
+		if key.ID == kid && now.Before(key.Expires) {
+			return key.Key.Public(), nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// JWKS returns the public keys of the active and retiring keys
+func (k *Keyring) JWKS() JWKSet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	set := JWKSet{Keys: []JWK{}}
+	keys := k.retiring
+	if k.active != nil {
+		keys = append([]*SigningKey{k.active}, keys...)
+	}
+	now := time.Now()
+	for _, key := range keys {
+		if !key.Expires.IsZero() && !now.Before(key.Expires) {
+			continue
+		}
+		jwk, err := publicJWK(key.Key.Public())
+		if err != nil {
+			continue
+		}
+		jwk.Kid = key.ID
+		jwk.Use = "sig"
+		jwk.Alg = key.Algorithm
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// ServeHTTP publishes the key set
+func (k *Keyring) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Add("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	_ = json.NewEncoder(w).Encode(k.JWKS())
+}
+
+func (k *Keyring) signingKey(key crypto.Signer) (*SigningKey, error) {
+	if algorithmOf(key) != k.algorithm {
+		return nil, errors.New("key does not match signing algorithm " + k.algorithm)
+	}
+	kid, err := Thumbprint(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{ID: kid, Algorithm: k.algorithm, Key: key}, nil
+}
+
+// GenerateSigningKey creates a private key for RS256, ES256 or EdDSA
+func GenerateSigningKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case jwt5.SigningMethodRS256.Alg():
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case jwt5.SigningMethodES256.Alg():
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt5.SigningMethodEdDSA.Alg():
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, errors.New("unsupported signing algorithm " + algorithm)
+}
+
+// ParseSigningKey parses a PKCS8, PKCS1 or SEC1 PEM encoded private key
+func ParseSigningKey(content []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("invalid signing key")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, errors.New("invalid signing key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// algorithmOf returns the signing algorithm used with key
+func algorithmOf(key crypto.Signer) string {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jwt5.SigningMethodRS256.Alg()
+	case *ecdsa.PrivateKey:
+		if k.Curve == elliptic.P256() {
+			return jwt5.SigningMethodES256.Alg()
+		}
+	case ed25519.PrivateKey:
+		return jwt5.SigningMethodEdDSA.Alg()
+	}
+	return ""
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of a public key, the same key
+// has the same kid on every replica
+func Thumbprint(key crypto.PublicKey) (string, error) {
+	jwk, err := publicJWK(key)
+	if err != nil {
+		return "", err
+	}
+	var members string
+	switch jwk.Kty {
+	case "RSA":
+		members = `{"e":"` + jwk.E + `","kty":"RSA","n":"` + jwk.N + `"}`
+	case "EC":
+		members = `{"crv":"` + jwk.Crv + `","kty":"EC","x":"` + jwk.X + `","y":"` + jwk.Y + `"}`
+	case "OKP":
+		members = `{"crv":"` + jwk.Crv + `","kty":"OKP","x":"` + jwk.X + `"}`
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func publicJWK(key crypto.PublicKey) (JWK, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", N: encode(k.N.Bytes()), E: encode(big.NewInt(int64(k.E)).Bytes())}, nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			Kty: "EC",
+			Crv: k.Curve.Params().Name,
+			X:   encode(k.X.FillBytes(make([]byte, size))),
+			Y:   encode(k.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: encode(k)}, nil
+	}
+	return JWK{}, errors.New("unsupported public key")
+}
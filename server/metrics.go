@@ -0,0 +1,43 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+)
+
+// metrics are the variables served by the metrics path. They are kept apart
+// from expvar, whose import serves its variables on http.DefaultServeMux.
+var metrics = struct {
+	mu   sync.RWMutex
+	vars map[string]func() interface{}
+}{vars: make(map[string]func() interface{})}
+
+// publishMetric serves the value of the function under name, unless a
+// variable is already published under it
+func publishMetric(name string, value func() interface{}) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if _, ok := metrics.vars[name]; !ok {
+		metrics.vars[name] = value
+	}
+}
+
+// metricsHandler writes the variables and the memory statistics as JSON
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values := make(map[string]interface{})
+		metrics.mu.RLock()
+		for name, value := range metrics.vars {
+			values[name] = value()
+		}
+		metrics.mu.RUnlock()
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		values["memstats"] = stats
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(values)
+	})
+}
@@ -2,12 +2,14 @@ package server
 
 import (
 	"context"
-	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
+// Limiter throttles requests by client address for IsThrottle, configured
+// from the THROTTLE_* variables when the server is created
 var Limiter = NewThrottle()
 
 // SetHeaders // prepare header response
@@ -15,9 +17,8 @@ func SetHeaders() Middleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
+			// cross-origin headers are set per route by CORS
 			(w).Header().Set("Content-Type", "application/json")
-			(w).Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-			(w).Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-JWT, Authorization, request-id")
 
 			// continue
 			h.ServeHTTP(w, r)
@@ -40,34 +41,16 @@ func Preflight() Middleware {
 }
 
 // IsAllowedOrigin enable cors within the http handler
+//
+// Deprecated: use CORS or a RouteGroup policy, which also answer preflight
+// requests with the methods of the route.
 func IsAllowedOrigin(allowedOrigin string) Middleware {
-	return func(h http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-			allowed := false
-			origin := ip(r)
-
-			// check if cors is available in list
-			origins := strings.Split(allowedOrigin, ",")
-			for _, v := range origins {
-				if v == origin {
-					allowed = true
-				}
-			}
-
-			// allow cors if found
-			if !allowed {
-				(w).WriteHeader(http.StatusForbidden)
-				return
-			}
-
-			// continue
-			h.ServeHTTP(w, r)
-		})
-	}
+	return CORS(CORSPolicy{
+		AllowedOrigins: strings.Split(allowedOrigin, ","),
+	}, http.MethodPost, http.MethodGet, http.MethodPut, http.MethodDelete)
 }
 
-// IsThrottle handle limits and rates
+// IsThrottle handle limits and rates, use RateLimit for limits per route or per key
 func IsThrottle() Middleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -84,56 +67,36 @@ func IsThrottle() Middleware {
 	}
 }
 
-// IsAllowedIPs allow specific IP address
+// IsAllowedIPs allow specific IP addresses and CIDR ranges, use an IPFilter
+// for deny lists and lists reloaded at runtime
 func IsAllowedIPs(allowedIps string) Middleware {
-	return func(h http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-			allowed := false
-			// check if ip is available in list
-			ips := strings.Split(allowedIps, ",")
-			for _, v := range ips {
-				if v == ip(r) {
-					allowed = true
-				}
-			}
-			// allow ip if found
-			if !allowed {
-				(w).WriteHeader(http.StatusForbidden)
-				return
-			}
-
-			// continue
-			h.ServeHTTP(w, r)
-		})
-	}
+	return allowListFilter("allowed-ips", allowedIps).Middleware()
 }
 
-// IsAuthorized validate if users is allowed to access route
+// IsAuthorized validate if users is allowed to access route, with the
+// permissions declared for the route by Roles or else the exact path. The
+// token is read from the context set by IsAuthenticated, or verified with jwt.
 func IsAuthorized(jwt JWT) Middleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			token, err := jwt.GetTokenInfo(r)
-			if err != nil {
+			token, ok := requestToken(jwt, r)
+			if !ok {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 
-			var allowed bool
-			var pattern = r.URL.Path
-			for _, value := range token.Permissions {
-				if value == pattern {
-					allowed = true
-				}
+			missing, allowed, err := currentRoles().Authorize(r.Context(), token, r.Method, r.URL.Path)
+			if err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
 			}
-
 			if !allowed {
-				w.WriteHeader(http.StatusUnauthorized)
+				forbidden(w, missing)
 				return
 			}
 
 			// continue
-			h.ServeHTTP(w, r)
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey, token)))
 		})
 	}
 }
@@ -142,10 +105,22 @@ func IsAuthorized(jwt JWT) Middleware {
 func ProcessTimeout(timeout time.Duration) Middleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			ctx, cancel := context.WithCancel(r.Context())
 			defer cancel()
-
-			r = r.WithContext(ctx)
+			timer := time.AfterFunc(timeout, cancel)
+			defer timer.Stop()
+
+			// handlers serving a stream, such as SSE, lift the limit once started
+			streaming := make(chan bool)
+			var once sync.Once
+			lift := func() {
+				once.Do(func() {
+					if timer.Stop() {
+						close(streaming)
+					}
+				})
+			}
+			r = r.WithContext(context.WithValue(ctx, streamingKey, lift))
 
 			processDone := make(chan bool)
 			go func() {
@@ -157,6 +132,8 @@ func ProcessTimeout(timeout time.Duration) Middleware {
 			case <-ctx.Done():
 				w.WriteHeader(http.StatusRequestTimeout)
 				return
+			case <-streaming:
+				<-processDone
 			case <-processDone:
 
 			}
@@ -164,23 +141,53 @@ func ProcessTimeout(timeout time.Duration) Middleware {
 	}
 }
 
-// IsAuthenticated validates request for jwt header
-func IsAuthenticated(jwt JWT) Middleware {
+const streamingKey contextKey = "streaming"
+
+// markStreaming exempts the request from the ProcessTimeout limit
+func markStreaming(ctx context.Context) {
+	if lift, ok := ctx.Value(streamingKey).(func()); ok {
+		lift()
+	}
+}
+
+// IsAuthenticated validates request for jwt header, and with sessions that
+// the session of the token was not revoked. With sessions, requests without
+// a token are authenticated by the session cookie.
+func IsAuthenticated(jwt JWT, sessions ...*Sessions) Middleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-			// validate jwt
-			if !jwt.IsValidToken(r) {
+			token, err := authenticate(r, jwt, sessions...)
+			if err != nil {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 
 			// continue
-			h.ServeHTTP(w, r)
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey, token)))
 		})
 	}
 }
 
+// authenticate returns the token of the request as IsAuthenticated checks it
+func authenticate(r *http.Request, jwt JWT, sessions ...*Sessions) (*TokenInfo, error) {
+	// validate jwt, or the session cookie of browser clients
+	token, err := jwt.GetTokenInfo(r)
+	if err != nil && len(sessions) > 0 && r.Header.Get("Authorization") == "" {
+		token, err = sessions[0].cookieToken(r.Context(), r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// validate session
+	for _, s := range sessions {
+		if err := s.Validate(r.Context(), token, SessionID(r, token)); err != nil {
+			return nil, err
+		}
+	}
+	return token, nil
+}
+
 // NoAuthentication access without authentications
 func NoAuthentication() Middleware {
 	return func(h http.Handler) http.Handler {
@@ -206,7 +213,7 @@ func Use(h http.Handler, m ...Middleware) http.Handler {
 	return wrapped
 }
 
+// ip returns the client address resolved through trusted proxies
 func ip(r *http.Request) string {
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return ip
+	return ClientIP(r)
 }
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/greatfocus/gf-sframe/broker"
+	"github.com/greatfocus/gf-sframe/database"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// ActorRoleSchema creates the table of the roles of actors read by
+// PostgresPermissions, next to RoleSchema
+const ActorRoleSchema = `
+CREATE TABLE IF NOT EXISTS actor_roles (
+	actor_id BIGINT NOT NULL,
+	role TEXT NOT NULL,
+	PRIMARY KEY (actor_id, role)
+);`
+
+// PermissionProvider returns the roles and permissions granted to an actor,
+// so tokens carry the actor id instead of every permission
+type PermissionProvider interface {
+	Permissions(ctx context.Context, actorID int64) ([]string, error)
+}
+
+// PermissionChange is broadcast when the roles of an actor change, an actor
+// id of 0 invalidates every actor
+type PermissionChange struct {
+	ActorID int64 `json:"actorId"`
+}
+
+// postgresPermissions reads the actor_roles and role_permissions tables
+type postgresPermissions struct {
+	db database.Database
+}
+
+// NewPostgresPermissions returns the roles of actors from the actor_roles
+// table, with the permissions of those roles from the role_permissions table
+func NewPostgresPermissions(db database.Database) PermissionProvider {
+	return &postgresPermissions{db: db}
+}
+
+func (p *postgresPermissions) Permissions(ctx context.Context, actorID int64) ([]string, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT role FROM actor_roles WHERE actor_id = $1
+		UNION
+		SELECT rp.permission FROM actor_roles ar
+		JOIN role_permissions rp ON rp.role = ar.role
+		WHERE ar.actor_id = $1`, actorID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	permissions := []string{}
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	return permissions, rows.Err()
+}
+
+// permissionsLoadTimeout bounds a load shared by concurrent requests
+const permissionsLoadTimeout = 10 * time.Second
+
+// CachedPermissions keeps the permissions of a provider for a TTL. Changes
+// broadcast on the broker invalidate them on every instance, the TTL bounds
+// how stale they get when a broadcast is missed.
+type CachedPermissions struct {
+	provider PermissionProvider
+	ttl      time.Duration
+	mu       sync.RWMutex
+	entries  map[int64]cachedPermissions
+	// generations count the invalidations of each actor and of every actor,
+	// loads started before an invalidation are not cached
+	generations map[int64]uint64
+	generation  uint64
+	loading     singleflight.Group
+}
+
+type cachedPermissions struct {
+	permissions []string
+	expires     time.Time
+}
+
+// NewCachedPermissions caches the permissions of provider for ttl
+func NewCachedPermissions(provider PermissionProvider, ttl time.Duration) *CachedPermissions {
+	return &CachedPermissions{
+		provider:    provider,
+		ttl:         ttl,
+		entries:     make(map[int64]cachedPermissions),
+		generations: make(map[int64]uint64),
+	}
+}
+
+// Permissions returns the cached permissions, loading them once for
+// concurrent requests of the same actor
+func (c *CachedPermissions) Permissions(ctx context.Context, actorID int64) ([]string, error) {
+	c.mu.RLock()
+	entry, ok := c.entries[actorID]
+	generation := c.generation + c.generations[actorID]
+	c.mu.RUnlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.permissions, nil
+	}
+
+	key := strconv.FormatInt(actorID, 10) + ":" + strconv.FormatUint(generation, 10)
+	value, err, _ := c.loading.Do(key, func() (interface{}, error) {
+		// the load is shared, so it does not end with the first request
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), permissionsLoadTimeout)
+		defer cancel()
+		permissions, err := c.provider.Permissions(loadCtx, actorID)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		if c.generation+c.generations[actorID] == generation {
+			c.entries[actorID] = cachedPermissions{permissions: permissions, expires: time.Now().Add(c.ttl)}
+		}
+		c.mu.Unlock()
+		return permissions, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]string), nil
+}
+
+// Invalidate drops the permissions of an actor, 0 drops every actor
+func (c *CachedPermissions) Invalidate(actorID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if actorID == 0 {
+		c.generation++
+		c.entries = make(map[int64]cachedPermissions)
+		return
+	}
+	c.generations[actorID]++
+	delete(c.entries, actorID)
+}
+
+// Subscribe invalidates the permissions changed by PublishPermissionChange
+// on any instance, until the context is cancelled
+func (c *CachedPermissions) Subscribe(ctx context.Context, connectionStr, exchange string, logger *logrus.Logger) error {
+	return broker.Subscribe(ctx, broker.SubscriberParam{
+		ConnectionStr: connectionStr,
+		Exchange:      exchange,
+		Handler: func(msg amqp.Delivery) error {
+			var change PermissionChange
+			if err := json.Unmarshal(msg.Body, &change); err != nil {
+				logger.Warn("Ignoring invalid permission change, because of " + err.Error())
+				return err
+			}
+			c.Invalidate(change.ActorID)
+			return nil
+		},
+		// changes broadcast while disconnected were missed
+		OnReconnect: func() {
+			c.Invalidate(0)
+		},
+		Logger: logger,
+	})
+}
+
+// PublishPermissionChange tells every instance that the roles of an actor changed
+func PublishPermissionChange(connectionStr, exchange, appID string, actorID int64) error {
+	data, err := json.Marshal(PermissionChange{ActorID: actorID})
+	if err != nil {
+		return err
+	}
+	return broker.Broadcast(broker.BroadcastParam{
+		ConnectionStr: connectionStr,
+		AppId:         appID,
+		Exchange:      exchange,
+		Data:          data,
+	})
+}
+
+// initPermissions loads permissions from postgres when PERMISSIONS_CACHE_TTL
+// (seconds) is set, invalidated by PERMISSIONS_BROKER_URL broadcasts on the
+// PERMISSIONS_EXCHANGE exchange
+func initPermissions(s *Server) {
+	val := os.Getenv("PERMISSIONS_CACHE_TTL")
+	if val == "" {
+		return
+	}
+	cached := NewCachedPermissions(NewPostgresPermissions(s.Database), time.Duration(parseFloatEnv(val)*float64(time.Second)))
+	if url := os.Getenv("PERMISSIONS_BROKER_URL"); url != "" {
+		exchange := os.Getenv("PERMISSIONS_EXCHANGE")
+		if exchange == "" {
+			exchange = "permissions"
+		}
+		if err := cached.Subscribe(context.Background(), url, exchange, s.Logger); err != nil {
+			log.Fatal(err)
+		}
+	}
+	Roles.Provider = cached
+}
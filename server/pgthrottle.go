@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/greatfocus/gf-sframe/database"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// ThrottleSchema creates the table shared by postgres throttles
+const ThrottleSchema = `
+CREATE TABLE IF NOT EXISTS throttle_gcra (
+	key TEXT PRIMARY KEY,
+	tat TIMESTAMPTZ NOT NULL,
+	granted INT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS throttle_gcra_tat ON throttle_gcra (tat);`
+
+// takeTokens grants up to $2 tokens using GCRA. tat is the theoretical
+// arrival time of the next request, the bucket is full when tat has passed and
+// each token pushes it by the emission interval $4 up to $3 intervals ahead.
+const takeTokens = `
+INSERT INTO throttle_gcra AS t (key, tat, granted)
+VALUES ($1, now() + make_interval(secs => LEAST($2::int, $3::int) * $4::float8), LEAST($2::int, $3::int))
+ON CONFLICT (key) DO UPDATE SET
+	granted = GREATEST(0, LEAST($2::int, FLOOR($3::int - EXTRACT(EPOCH FROM GREATEST(t.tat, now()) - now()) / $4::float8)))::int,
+	tat = GREATEST(t.tat, now()) + make_interval(secs => GREATEST(0, LEAST($2::int, FLOOR($3::int - EXTRACT(EPOCH FROM GREATEST(t.tat, now()) - now()) / $4::float8))) * $4::float8)
+RETURNING granted, EXTRACT(EPOCH FROM tat - now())::float8`
+
+// PostgresThrottleConfig configures a throttle shared by all replicas
+type PostgresThrottleConfig struct {
+	// Name separates the keys of throttles sharing the table, such as one per route
+	Name string
+	// Rate is the number of requests per second refilled for each key, it
+	// must be positive and finite
+	Rate  rate.Limit
+	Burst int
+	// Prefetch is the number of tokens taken from the store at once and
+	// spent locally, trading accuracy for fewer queries
+	Prefetch int
+	// Lease is how long prefetched tokens may be spent, unspent tokens are lost
+	Lease time.Duration
+	// Timeout bounds each query to the store
+	Timeout time.Duration
+	// Retry is how long the store is bypassed after it failed
+	Retry time.Duration
+	// Fallback limits requests while the store is unavailable, by default a
+	// local throttle with the same rate and burst
+	Fallback Throttle
+	Logger   *logrus.Logger
+}
+
+// postgresThrottle limits requests with GCRA state stored in postgres
+type postgresThrottle struct {
+	db       database.Database
+	config   PostgresThrottleConfig
+	mu       sync.Mutex
+	leases   map[string]*tokenLease
+	retryAt  time.Time
+	eviction sync.Once
+}
+
+// tokenLease holds the tokens prefetched for a key
+type tokenLease struct {
+	mu        sync.Mutex
+	tokens    int
+	remaining int
+	expires   time.Time
+	reset     time.Time
+	blocked   time.Time
+}
+
+// NewPostgresThrottle creates a throttle whose limits hold across replicas.
+// ThrottleSchema must have been applied to the database.
+func NewPostgresThrottle(db database.Database, config PostgresThrottleConfig) (Throttle, error) {
+	if !(config.Rate > 0 && config.Rate < rate.Inf) {
+		return nil, errors.New("throttle rate must be positive and finite")
+	}
+	if config.Prefetch <= 0 {
+		config.Prefetch = int(math.Max(1, float64(config.Burst)/10))
+	}
+	if config.Lease <= 0 {
+		config.Lease = time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 100 * time.Millisecond
+	}
+	if config.Retry <= 0 {
+		config.Retry = 5 * time.Second
+	}
+	if config.Fallback == nil {
+		config.Fallback = NewKeyedThrottle(ThrottleConfig{Rate: config.Rate, Burst: config.Burst})
+	}
+	if config.Logger == nil {
+		config.Logger = logrus.StandardLogger()
+	}
+	return &postgresThrottle{
+		db:     db,
+		config: config,
+		leases: make(map[string]*tokenLease),
+	}, nil
+}
+
+// IsThrottled takes a request for key and reports whether it was rejected
+func (p *postgresThrottle) IsThrottled(key string) bool {
+	return !p.Take(key).Allowed
+}
+
+// Take spends a prefetched token for key, fetching more from the store when
+// none are left. Requests fall back to local limiting while the store fails.
+func (p *postgresThrottle) Take(key string) RateLimitResult {
+	p.eviction.Do(func() {
+		go p.evict()
+	})
+	now := time.Now()
+	lease := p.lease(key)
+	lease.mu.Lock()
+	defer lease.mu.Unlock()
+
+	if lease.tokens > 0 && now.Before(lease.expires) {
+		lease.tokens--
+		return lease.result(now, p.config.Burst, true)
+	}
+	if now.Before(lease.blocked) {
+		return lease.result(now, p.config.Burst, false)
+	}
+	if !p.available(now) {
+		return p.config.Fallback.Take(key)
+	}
+
+	granted, wait, err := p.fetch(key)
+	if err != nil {
+		p.unavailable(now, err)
+		return p.config.Fallback.Take(key)
+	}
+
+	interval := p.interval()
+	lease.reset = now.Add(wait)
+	lease.remaining = int(math.Max(0, math.Floor(float64(p.config.Burst)-wait.Seconds()/interval.Seconds())))
+	if granted == 0 {
+		// the next token frees once tat is less than burst intervals ahead
+		lease.tokens = 0
+		lease.blocked = now.Add(wait - time.Duration(p.config.Burst-1)*interval)
+		return lease.result(now, p.config.Burst, false)
+	}
+	lease.tokens = granted - 1
+	lease.expires = now.Add(p.config.Lease)
+	return lease.result(now, p.config.Burst, true)
+}
+
+// fetch takes up to Prefetch tokens from the store, returning the granted
+// tokens and the time until the bucket is full
+func (p *postgresThrottle) fetch(key string) (int, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+
+	rows, err := p.db.Query(ctx, takeTokens, p.config.Name+":"+key, p.config.Prefetch, p.config.Burst, p.interval().Seconds())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var granted int
+	var seconds float64
+	if rows.Next() {
+		if err := rows.Scan(&granted, &seconds); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	return granted, time.Duration(seconds * float64(time.Second)), nil
+}
+
+func (p *postgresThrottle) interval() time.Duration {
+	return time.Duration(float64(time.Second) / float64(p.config.Rate))
+}
+
+func (p *postgresThrottle) lease(key string) *tokenLease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lease, exists := p.leases[key]
+	if !exists {
+		lease = &tokenLease{}
+		p.leases[key] = lease
+	}
+	return lease
+}
+
+func (p *postgresThrottle) available(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !now.Before(p.retryAt)
+}
+
+func (p *postgresThrottle) unavailable(now time.Time, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Before(p.retryAt) {
+		return
+	}
+	p.retryAt = now.Add(p.config.Retry)
+	p.config.Logger.Error("Throttle store unavailable, limiting locally, because of " + err.Error())
+}
+
+// evict removes idle leases and the rows of full buckets
+func (p *postgresThrottle) evict() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		p.mu.Lock()
+		for key, lease := range p.leases {
+			if lease.mu.TryLock() {
+				if now.After(lease.expires) && now.After(lease.blocked) {
+					delete(p.leases, key)
+				}
+				lease.mu.Unlock()
+			}
+		}
+		p.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_ = p.db.Delete(ctx, "DELETE FROM throttle_gcra WHERE tat < now()")
+		cancel()
+	}
+}
+
+func (l *tokenLease) result(now time.Time, limit int, allowed bool) RateLimitResult {
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: l.remaining + l.tokens,
+		Reset:     l.reset.Sub(now),
+	}
+	if result.Reset < 0 {
+		result.Reset = 0
+	}
+	if !allowed {
+		result.RetryAfter = l.blocked.Sub(now)
+		if result.RetryAfter <= 0 {
+			result.RetryAfter = time.Second
+		}
+	}
+	return result
+}
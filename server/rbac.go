@@ -0,0 +1,344 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/greatfocus/gf-sframe/database"
+	"github.com/sirupsen/logrus"
+)
+
+// RoleSchema creates the table read by DatabaseRoles
+const RoleSchema = `
+CREATE TABLE IF NOT EXISTS role_permissions (
+	role TEXT NOT NULL,
+	permission TEXT NOT NULL,
+	PRIMARY KEY (role, permission)
+);`
+
+// Roles authorizes the requests of IsAuthorized, routes without declared
+// permissions keep the exact path permissions
+var Roles *RBAC
+
+// RoleDefinitions map role names to permissions such as orders:read
+type RoleDefinitions map[string][]string
+
+// RoleSource loads the role definitions
+type RoleSource func(ctx context.Context) (RoleDefinitions, error)
+
+// RBAC grants permissions through roles. Permissions are colon separated
+// segments, a * segment matches any segment and a trailing * matches the
+// remaining segments, so orders:* grants orders:read and orders:items:update.
+// Token permissions name roles, or grant a permission directly.
+type RBAC struct {
+	// Provider grants the actor of a token permissions next to those the
+	// token carries
+	Provider PermissionProvider
+	source   RoleSource
+	logger   *logrus.Logger
+	mu       sync.RWMutex
+	roles    RoleDefinitions
+	routes   []routePermission
+}
+
+// routePermission are the permissions required by the requests of a route
+type routePermission struct {
+	method      string
+	segments    []string
+	permissions []string
+}
+
+// NewRBAC creates the roles and loads their definitions
+func NewRBAC(source RoleSource, logger *logrus.Logger) (*RBAC, error) {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	a := &RBAC{
+		source: source,
+		logger: logger,
+		roles:  RoleDefinitions{},
+	}
+	if err := a.Reload(context.Background()); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload replaces the roles with the current source content, the previous
+// roles are kept when the source fails
+func (a *RBAC) Reload(ctx context.Context) error {
+	roles, err := a.source(ctx)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.roles = roles
+	a.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the roles periodically until the context is cancelled
+func (a *RBAC) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.Reload(ctx); err != nil {
+				a.logger.Error("Reloading roles failed, because of " + err.Error())
+			}
+		}
+	}
+}
+
+// Route declares the permissions required by a route. An empty method or *
+// matches every method, {name} and * path segments match any segment and a
+// trailing /* matches the remaining path. Routes are matched in declaration
+// order.
+func (a *RBAC) Route(method, pattern string, permissions ...string) {
+	if method == "*" {
+		method = ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.routes = append(a.routes, routePermission{
+		method:      strings.ToUpper(method),
+		segments:    strings.Split(strings.Trim(pattern, "/"), "/"),
+		permissions: permissions,
+	})
+}
+
+// Required returns the permissions declared for the request method and path
+func (a *RBAC) Required(method, path string) ([]string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, route := range a.routes {
+		if route.method != "" && route.method != method {
+			continue
+		}
+		if matchSegments(route.segments, segments, isPathWildcard) {
+			return route.permissions, true
+		}
+	}
+	return nil, false
+}
+
+// Permissions expands the roles of grants into their permissions
+func (a *RBAC) Permissions(grants []string) []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var permissions []string
+	for _, grant := range grants {
+		if role, ok := a.roles[grant]; ok {
+			permissions = append(permissions, role...)
+			continue
+		}
+		permissions = append(permissions, grant)
+	}
+	return permissions
+}
+
+// Missing returns the first required permission the grants lack
+func (a *RBAC) Missing(grants []string, required ...string) (string, bool) {
+	permissions := a.Permissions(grants)
+	for _, permission := range required {
+		if !hasPermission(permissions, permission) {
+			return permission, true
+		}
+	}
+	return "", false
+}
+
+// Authorize returns the permission the token lacks for the request, routes
+// without declared permissions require their exact path
+func (a *RBAC) Authorize(ctx context.Context, token *TokenInfo, method, path string) (string, bool, error) {
+	grants, err := a.grants(ctx, token)
+	if err != nil {
+		return "", false, err
+	}
+	required, ok := a.Required(method, path)
+	if !ok {
+		for _, permission := range grants {
+			if permission == path {
+				return "", true, nil
+			}
+		}
+		return path, false, nil
+	}
+	missing, lacking := a.Missing(grants, required...)
+	return missing, !lacking, nil
+}
+
+// Require rejects requests whose token lacks any of the permissions. The
+// token is read from the context set by IsAuthenticated, or verified with jwt.
+func (a *RBAC) Require(jwt JWT, permissions ...string) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := requestToken(jwt, r)
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			grants, err := a.grants(r.Context(), token)
+			if err != nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if missing, lacking := a.Missing(grants, permissions...); lacking {
+				forbidden(w, missing)
+				return
+			}
+
+			// continue
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey, token)))
+		})
+	}
+}
+
+// grants are the permissions of the token and those the provider grants its actor
+func (a *RBAC) grants(ctx context.Context, token *TokenInfo) ([]string, error) {
+	if a.Provider == nil || token.ActorID == 0 || token.APIKey != "" {
+		return token.Permissions, nil
+	}
+	permissions, err := a.Provider.Permissions(ctx, token.ActorID)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]string{}, token.Permissions...), permissions...), nil
+}
+
+// StaticRoles returns fixed role definitions
+func StaticRoles(roles RoleDefinitions) RoleSource {
+	return func(context.Context) (RoleDefinitions, error) {
+		return roles, nil
+	}
+}
+
+// FileRoles reads role definitions from a JSON object of role names to
+// permission lists
+func FileRoles(path string) RoleSource {
+	return func(context.Context) (RoleDefinitions, error) {
+		content, err := os.ReadFile(filepath.Clean(path))
+		if err != nil {
+			return nil, err
+		}
+		roles := RoleDefinitions{}
+		if err := json.Unmarshal(content, &roles); err != nil {
+			return nil, err
+		}
+		return roles, nil
+	}
+}
+
+// DatabaseRoles reads role definitions from the role_permissions table
+func DatabaseRoles(db database.Database) RoleSource {
+	return func(ctx context.Context) (RoleDefinitions, error) {
+		rows, err := db.Query(ctx, "SELECT role, permission FROM role_permissions")
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
+		roles := RoleDefinitions{}
+		for rows.Next() {
+			var role, permission string
+			if err := rows.Scan(&role, &permission); err != nil {
+				return nil, err
+			}
+			roles[role] = append(roles[role], permission)
+		}
+		return roles, rows.Err()
+	}
+}
+
+// initRBAC loads the roles of RBAC_ROLES_FILE, reloaded every
+// RBAC_RELOAD_INTERVAL seconds when set
+func initRBAC(logger *logrus.Logger) *RBAC {
+	source := StaticRoles(RoleDefinitions{})
+	path := os.Getenv("RBAC_ROLES_FILE")
+	if path != "" {
+		source = FileRoles(path)
+	}
+	roles, err := NewRBAC(source, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if val := os.Getenv("RBAC_RELOAD_INTERVAL"); val != "" && path != "" {
+		interval := time.Duration(parseFloatEnv(val) * float64(time.Second))
+		if interval <= 0 {
+			log.Fatal("RBAC_RELOAD_INTERVAL must be positive")
+		}
+		go roles.Watch(context.Background(), interval)
+	}
+	return roles
+}
+
+// currentRoles returns Roles, or roles without definitions for servers not
+// created with NewServer
+func currentRoles() *RBAC {
+	if Roles == nil {
+		return &RBAC{}
+	}
+	return Roles
+}
+
+// requestToken returns the token of the context, or verifies the request token
+func requestToken(jwt JWT, r *http.Request) (*TokenInfo, bool) {
+	if token, ok := TokenFromContext(r.Context()); ok {
+		return token, true
+	}
+	token, err := jwt.GetTokenInfo(r)
+	return token, err == nil
+}
+
+// forbidden responds 403 naming the missing permission
+func forbidden(w http.ResponseWriter, permission string) {
+	out, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{Error: "missing permission " + permission})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(w).Encode(Response{Result: string(out)})
+}
+
+func hasPermission(granted []string, required string) bool {
+	want := strings.Split(required, ":")
+	for _, permission := range granted {
+		if matchSegments(strings.Split(permission, ":"), want, func(s string) bool { return s == "*" }) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments matches values against a pattern, wildcard pattern segments
+// match any segment and a trailing * matches the remaining segments
+func matchSegments(pattern, values []string, wildcard func(string) bool) bool {
+	for i, segment := range pattern {
+		if segment == "*" && i == len(pattern)-1 {
+			return len(values) >= i
+		}
+		if i >= len(values) {
+			return false
+		}
+		if !wildcard(segment) && segment != values[i] {
+			return false
+		}
+	}
+	return len(pattern) == len(values)
+}
+
+func isPathWildcard(segment string) bool {
+	return segment == "*" || (strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}"))
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestHasPermission(t *testing.T) {
+	tests := []struct {
+		granted  []string
+		required string
+		want     bool
+	}{
+		{[]string{"orders:read"}, "orders:read", true},
+		{[]string{"orders:read"}, "orders:update", false},
+		{[]string{"orders:read"}, "orders", false},
+		{[]string{"orders:read"}, "orders:read:all", false},
+		{[]string{"orders:*"}, "orders:read", true},
+		{[]string{"orders:*"}, "orders:items:update", true},
+		{[]string{"orders:*"}, "invoices:read", false},
+		{[]string{"*:read"}, "orders:read", true},
+		{[]string{"*:read"}, "orders:update", false},
+		{[]string{"*:read"}, "orders:items:read", false},
+		{[]string{"orders:*:update"}, "orders:items:update", true},
+		{[]string{"orders:*:update"}, "orders:items:read", false},
+		{[]string{"*"}, "anything:at:all", true},
+		{[]string{"invoices:read", "orders:*"}, "orders:read", true},
+		{nil, "orders:read", false},
+	}
+	for _, tt := range tests {
+		if got := hasPermission(tt.granted, tt.required); got != tt.want {
+			t.Errorf("hasPermission(%v, %q) = %v, want %v", tt.granted, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestRBACRequired(t *testing.T) {
+	roles := &RBAC{}
+	roles.Route(http.MethodGet, "/orders/{id}", "orders:read")
+	roles.Route("*", "/orders/{id}", "orders:update")
+	roles.Route(http.MethodGet, "/files/*", "files:read")
+
+	tests := []struct {
+		method, path string
+		want         string
+		ok           bool
+	}{
+		{http.MethodGet, "/orders/42", "orders:read", true},
+		{http.MethodPut, "/orders/42", "orders:update", true},
+		{http.MethodGet, "/orders/42/items", "", false},
+		{http.MethodGet, "/orders", "", false},
+		{http.MethodGet, "/files/a/b/c", "files:read", true},
+		{http.MethodPost, "/files/a", "", false},
+	}
+	for _, tt := range tests {
+		required, ok := roles.Required(tt.method, tt.path)
+		if ok != tt.ok || (ok && (len(required) != 1 || required[0] != tt.want)) {
+			t.Errorf("Required(%s, %s) = %v, %v, want %s, %v", tt.method, tt.path, required, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+type stubPermissions map[int64][]string
+
+func (s stubPermissions) Permissions(ctx context.Context, actorID int64) ([]string, error) {
+	if actorID < 0 {
+		return nil, errors.New("store unavailable")
+	}
+	return s[actorID], nil
+}
+
+func TestRBACAuthorize(t *testing.T) {
+	roles, err := NewRBAC(StaticRoles(RoleDefinitions{
+		"clerk": {"orders:read", "orders:items:*"},
+		"admin": {"*"},
+	}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles.Route(http.MethodGet, "/orders/{id}", "orders:read")
+	roles.Route(http.MethodDelete, "/orders/{id}", "orders:delete")
+	roles.Route(http.MethodPut, "/orders/{id}/items/{item}", "orders:items:update")
+	roles.Provider = stubPermissions{7: {"admin"}}
+
+	tests := []struct {
+		name         string
+		token        *TokenInfo
+		method, path string
+		allowed      bool
+		missing      string
+	}{
+		{"role grants permission", &TokenInfo{Permissions: []string{"clerk"}}, http.MethodGet, "/orders/1", true, ""},
+		{"role wildcard", &TokenInfo{Permissions: []string{"clerk"}}, http.MethodPut, "/orders/1/items/2", true, ""},
+		{"role lacks permission", &TokenInfo{Permissions: []string{"clerk"}}, http.MethodDelete, "/orders/1", false, "orders:delete"},
+		{"direct permission", &TokenInfo{Permissions: []string{"orders:delete"}}, http.MethodDelete, "/orders/1", true, ""},
+		{"undeclared route needs its path", &TokenInfo{Permissions: []string{"clerk"}}, http.MethodGet, "/reports", false, "/reports"},
+		{"undeclared route with its path", &TokenInfo{Permissions: []string{"/reports"}}, http.MethodGet, "/reports", true, ""},
+		{"provider grants role", &TokenInfo{ActorID: 7}, http.MethodDelete, "/orders/1", true, ""},
+		{"provider does not extend api keys", &TokenInfo{ActorID: 7, APIKey: "k1", Permissions: []string{"orders:read"}}, http.MethodDelete, "/orders/1", false, "orders:delete"},
+	}
+	for _, tt := range tests {
+		missing, allowed, err := roles.Authorize(context.Background(), tt.token, tt.method, tt.path)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if allowed != tt.allowed || missing != tt.missing {
+			t.Errorf("%s: Authorize = %q, %v, want %q, %v", tt.name, missing, allowed, tt.missing, tt.allowed)
+		}
+	}
+
+	if _, _, err := roles.Authorize(context.Background(), &TokenInfo{ActorID: -1}, http.MethodGet, "/orders/1"); err == nil {
+		t.Error("provider failure was not returned")
+	}
+}
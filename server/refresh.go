@@ -0,0 +1,328 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/greatfocus/gf-sframe/database"
+	"github.com/sirupsen/logrus"
+)
+
+// RefreshTokenSchema creates the table of refresh tokens
+const RefreshTokenSchema = `
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token_hash TEXT PRIMARY KEY,
+	family_id TEXT NOT NULL,
+	actor_id BIGINT NOT NULL,
+	session_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	token_info JSONB NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	rotated_at TIMESTAMPTZ,
+	revoked_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family ON refresh_tokens (family_id);
+CREATE INDEX IF NOT EXISTS refresh_tokens_session ON refresh_tokens (session_id);
+CREATE INDEX IF NOT EXISTS refresh_tokens_actor ON refresh_tokens (actor_id);`
+
+// DeviceIDHeader carries the device a refresh token is bound to
+const DeviceIDHeader = "Device-Id"
+
+var (
+	// ErrInvalidRefreshToken is returned for unknown, expired or revoked refresh tokens
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when a rotated refresh token is
+	// presented again, its whole family is revoked
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// TokenPair is a short lived access token and the refresh token renewing it
+type TokenPair struct {
+	AccessToken  string    `json:"accessToken"`
+	RefreshToken string    `json:"refreshToken"`
+	TokenType    string    `json:"tokenType"`
+	ExpiresAt    time.Time `json:"refreshExpiresAt"`
+}
+
+// RefreshBinding binds a refresh token family to a session and a device
+type RefreshBinding struct {
+	SessionID string
+	DeviceID  string
+}
+
+// RefreshTokens issues opaque refresh tokens stored hashed in postgres. Each
+// refresh rotates the token, tokens issued from one login form a family that
+// is revoked when a rotated token is reused. A family expires lifetime after
+// the login, however often it is refreshed.
+type RefreshTokens struct {
+	// Claims returns the current claims of the actor of a refreshed token,
+	// such as roles granted or removed since the login. The claims of the
+	// login are kept when nil.
+	Claims   func(ctx context.Context, info TokenInfo) (TokenInfo, error)
+	db       database.Database
+	jwt      JWT
+	lifetime time.Duration
+	logger   *logrus.Logger
+}
+
+// NewRefreshTokens creates refresh tokens valid for lifetime, issuing access
+// tokens with jwt. RefreshTokenSchema must have been applied to the database.
+func NewRefreshTokens(db database.Database, jwt JWT, lifetime time.Duration, logger *logrus.Logger) *RefreshTokens {
+	if lifetime <= 0 {
+		lifetime = 30 * 24 * time.Hour
+	}
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	return &RefreshTokens{
+		db:       db,
+		jwt:      jwt,
+		lifetime: lifetime,
+		logger:   logger,
+	}
+}
+
+// Issue starts a token family after a login
+func (t *RefreshTokens) Issue(ctx context.Context, info TokenInfo, binding RefreshBinding) (*TokenPair, error) {
+	pair, _, err := t.issue(ctx, info, randomHex(16), binding, time.Now().Add(t.lifetime))
+	return pair, err
+}
+
+// Refresh rotates the refresh token, presented from the device it is bound to.
+// The new token is stored before the presented one is marked rotated, so a
+// failure in between leaves the presented token usable instead of none.
+func (t *RefreshTokens) Refresh(ctx context.Context, refreshToken, deviceID string) (*TokenPair, error) {
+	hash := hashRefreshToken(refreshToken)
+	var familyID, sessionID string
+	var content []byte
+	var expires time.Time
+	found, err := scanRow(ctx, t.db, `
+		SELECT family_id, session_id, token_info, expires_at FROM refresh_tokens
+		WHERE token_hash = $1 AND device_id = $2
+			AND rotated_at IS NULL AND revoked_at IS NULL AND expires_at > now()`,
+		[]interface{}{hash, deviceID}, &familyID, &sessionID, &content, &expires)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, t.rejected(ctx, hash, deviceID)
+	}
+
+	var info TokenInfo
+	if err := json.Unmarshal(content, &info); err != nil {
+		return nil, err
+	}
+	claims := info
+	if t.Claims != nil {
+		if claims, err = t.Claims(ctx, info); err != nil {
+			return nil, err
+		}
+	}
+	pair, issued, err := t.issue(ctx, claims, familyID, RefreshBinding{SessionID: sessionID, DeviceID: deviceID}, expires)
+	if err != nil {
+		return nil, err
+	}
+
+	// a concurrent refresh rotated the token first, the token was reused
+	if !t.db.Update(ctx, `
+		UPDATE refresh_tokens SET rotated_at = now()
+		WHERE token_hash = $1 AND rotated_at IS NULL AND revoked_at IS NULL`, hash) {
+		t.db.Delete(ctx, "DELETE FROM refresh_tokens WHERE token_hash = $1", issued)
+		return nil, t.rejected(ctx, hash, deviceID)
+	}
+	return pair, nil
+}
+
+// rejected revokes the family of a reused token or of a token presented from
+// another device, both signs of a stolen token
+func (t *RefreshTokens) rejected(ctx context.Context, hash, deviceID string) error {
+	var familyID, boundDevice string
+	var rotated bool
+	found, err := scanRow(ctx, t.db, `
+		SELECT family_id, device_id, rotated_at IS NOT NULL
+		FROM refresh_tokens WHERE token_hash = $1 AND revoked_at IS NULL`, []interface{}{hash}, &familyID, &boundDevice, &rotated)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrInvalidRefreshToken
+	}
+	if !rotated && boundDevice == deviceID {
+		// expired
+		return ErrInvalidRefreshToken
+	}
+
+	t.logger.WithFields(logrus.Fields{
+		"family": familyID,
+		"reused": rotated,
+	}).Warn("Revoking refresh token family")
+	t.revokeFamily(ctx, familyID)
+	if rotated {
+		return ErrRefreshTokenReused
+	}
+	return ErrInvalidRefreshToken
+}
+
+// Revoke revokes the family of the refresh token, such as on logout
+func (t *RefreshTokens) Revoke(ctx context.Context, refreshToken string) error {
+	var familyID string
+	found, err := scanRow(ctx, t.db, "SELECT family_id FROM refresh_tokens WHERE token_hash = $1",
+		[]interface{}{hashRefreshToken(refreshToken)}, &familyID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrInvalidRefreshToken
+	}
+	t.revokeFamily(ctx, familyID)
+	return nil
+}
+
+// RevokeSession revokes the refresh tokens of a session
+func (t *RefreshTokens) RevokeSession(ctx context.Context, sessionID string) {
+	t.db.Update(ctx, "UPDATE refresh_tokens SET revoked_at = now() WHERE session_id = $1 AND revoked_at IS NULL", sessionID)
+}
+
+// RevokeActor revokes every refresh token of an actor, such as after a
+// password change
+func (t *RefreshTokens) RevokeActor(ctx context.Context, actorID int64) {
+	t.db.Update(ctx, "UPDATE refresh_tokens SET revoked_at = now() WHERE actor_id = $1 AND revoked_at IS NULL", actorID)
+}
+
+// Purge deletes refresh tokens expired for longer than retention
+func (t *RefreshTokens) Purge(ctx context.Context, retention time.Duration) {
+	t.db.Delete(ctx, "DELETE FROM refresh_tokens WHERE expires_at < $1", time.Now().Add(-retention))
+}
+
+func (t *RefreshTokens) revokeFamily(ctx context.Context, familyID string) {
+	t.db.Update(ctx, "UPDATE refresh_tokens SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL", familyID)
+}
+
+// issue stores a refresh token of the family expiring with it, returning
+// the token pair and the hash of the refresh token
+func (t *RefreshTokens) issue(ctx context.Context, info TokenInfo, familyID string, binding RefreshBinding, expires time.Time) (*TokenPair, string, error) {
+	accessToken, err := t.jwt.CreateToken(info)
+	if err != nil {
+		return nil, "", err
+	}
+	content, err := json.Marshal(info)
+	if err != nil {
+		return nil, "", err
+	}
+
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return nil, "", err
+	}
+	hash := hashRefreshToken(refreshToken)
+	_, ok := t.db.Insert(ctx, `
+		INSERT INTO refresh_tokens (token_hash, family_id, actor_id, session_id, device_id, token_info, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		hash, familyID, info.ActorID, binding.SessionID, binding.DeviceID, string(content), expires)
+	if !ok {
+		return nil, "", errors.New("storing refresh token failed")
+	}
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresAt:    expires,
+	}, hash, nil
+}
+
+// RefreshHandler rotates the refreshToken param of POST requests, presented
+// with the Device-Id header
+func (s *Server) RefreshHandler(tokens *RefreshTokens) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Add("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		refreshToken, ok := s.refreshTokenParam(w, r)
+		if !ok {
+			return
+		}
+		pair, err := tokens.Refresh(r.Context(), refreshToken, r.Header.Get(DeviceIDHeader))
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			s.Error(w, r, err)
+			return
+		}
+		s.Success(w, r, pair)
+	})
+}
+
+// RevokeHandler revokes the family of the refreshToken param of POST requests
+func (s *Server) RevokeHandler(tokens *RefreshTokens) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Add("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		refreshToken, ok := s.refreshTokenParam(w, r)
+		if !ok {
+			return
+		}
+		// unknown tokens are not reported, revoking is idempotent
+		_ = tokens.Revoke(r.Context(), refreshToken)
+		s.Success(w, r, struct{}{})
+	})
+}
+
+func (s *Server) refreshTokenParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	params, err := s.Request(w, r)
+	if err != nil {
+		return "", false
+	}
+	values, _ := params.(map[string]interface{})
+	refreshToken, _ := values["refreshToken"].(string)
+	if refreshToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		s.Error(w, r, ErrInvalidRefreshToken)
+		return "", false
+	}
+	return refreshToken, true
+}
+
+// newRefreshToken returns an opaque token of 256 random bits
+func newRefreshToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// scanRow scans the first row of the query, reporting whether there was one
+func scanRow(ctx context.Context, db database.Database, query string, args []interface{}, dest ...interface{}) (bool, error) {
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	if !rows.Next() {
+		return false, rows.Err()
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hashRefreshToken hashes tokens for storage, a fast hash suffices for random tokens
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
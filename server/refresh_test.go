@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// refreshRow is a row of the refresh_tokens table
+type refreshRow struct {
+	family, session, device string
+	actorID                 int64
+	info                    []byte
+	expires                 time.Time
+	rotated, revoked        bool
+}
+
+// refreshStore is an in-memory refresh_tokens table answering the queries
+// of RefreshTokens, queries go through a database/sql driver so scanRow
+// reads real rows
+type refreshStore struct {
+	mu   sync.Mutex
+	rows map[string]*refreshRow
+	db   *sql.DB
+}
+
+func newRefreshStore() *refreshStore {
+	s := &refreshStore{rows: make(map[string]*refreshRow)}
+	s.db = sql.OpenDB(s)
+	return s
+}
+
+func (s *refreshStore) Connect(context.Context) (driver.Conn, error) { return refreshConn{s}, nil }
+func (s *refreshStore) Driver() driver.Driver                        { return nil }
+
+func (s *refreshStore) Query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.QueryContext(ctx, query, args...)
+}
+
+func (s *refreshStore) Select(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRowContext(ctx, query, args...)
+}
+
+func (s *refreshStore) Insert(ctx context.Context, query string, args ...interface{}) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash := args[0].(string)
+	if _, ok := s.rows[hash]; ok {
+		return 0, false
+	}
+	s.rows[hash] = &refreshRow{
+		family:  args[1].(string),
+		actorID: args[2].(int64),
+		session: args[3].(string),
+		device:  args[4].(string),
+		info:    []byte(args[5].(string)),
+		expires: args[6].(time.Time),
+	}
+	return 1, true
+}
+
+func (s *refreshStore) Update(ctx context.Context, query string, args ...interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	updated := false
+	for hash, row := range s.rows {
+		switch {
+		case strings.Contains(query, "SET rotated_at"):
+			if hash == args[0] && !row.rotated && !row.revoked {
+				row.rotated, updated = true, true
+			}
+		case strings.Contains(query, "WHERE family_id"):
+			if row.family == args[0] && !row.revoked {
+				row.revoked, updated = true, true
+			}
+		case strings.Contains(query, "WHERE session_id"):
+			if row.session == args[0] && !row.revoked {
+				row.revoked, updated = true, true
+			}
+		}
+	}
+	return updated
+}
+
+func (s *refreshStore) Delete(ctx context.Context, query string, args ...interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.rows[args[0].(string)]
+	delete(s.rows, args[0].(string))
+	return ok
+}
+
+func (s *refreshStore) RunSchema(schemas []string, logger *logrus.Logger) {}
+func (s *refreshStore) RebuildIndexes(logger *logrus.Logger)              {}
+
+// query answers the selects of RefreshTokens
+func (s *refreshStore) query(query string, args []driver.NamedValue) (driver.Rows, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	row, ok := s.rows[args[0].Value.(string)]
+	result := &refreshRows{}
+	switch {
+	case strings.Contains(query, "SELECT family_id, session_id"):
+		result.columns = []string{"family_id", "session_id", "token_info", "expires_at"}
+		if ok && row.device == args[1].Value && !row.rotated && !row.revoked && row.expires.After(time.Now()) {
+			result.values = [][]driver.Value{{row.family, row.session, row.info, row.expires}}
+		}
+	case strings.Contains(query, "SELECT family_id, device_id"):
+		result.columns = []string{"family_id", "device_id", "rotated"}
+		if ok && !row.revoked {
+			result.values = [][]driver.Value{{row.family, row.device, row.rotated}}
+		}
+	case strings.Contains(query, "SELECT family_id FROM"):
+		result.columns = []string{"family_id"}
+		if ok {
+			result.values = [][]driver.Value{{row.family}}
+		}
+	default:
+		return nil, errors.New("unexpected query " + query)
+	}
+	return result, nil
+}
+
+func (s *refreshStore) row(t *testing.T, refreshToken string) *refreshRow {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	row, ok := s.rows[hashRefreshToken(refreshToken)]
+	if !ok {
+		t.Fatal("refresh token not stored")
+	}
+	copied := *row
+	return &copied
+}
+
+type refreshConn struct {
+	store *refreshStore
+}
+
+func (c refreshConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+func (c refreshConn) Close() error { return nil }
+func (c refreshConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+func (c refreshConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.store.query(query, args)
+}
+
+type refreshRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *refreshRows) Columns() []string { return r.columns }
+func (r *refreshRows) Close() error      { return nil }
+
+func (r *refreshRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func newTestRefreshTokens() (*RefreshTokens, *refreshStore) {
+	store := newRefreshStore()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return NewRefreshTokens(store, NewJWT("refresh-test-secret", 15, false), time.Hour, logger), store
+}
+
+var testBinding = RefreshBinding{SessionID: "session-1", DeviceID: "device-1"}
+
+func TestRefreshRotation(t *testing.T) {
+	tokens, store := newTestRefreshTokens()
+	ctx := context.Background()
+	tokens.Claims = func(ctx context.Context, info TokenInfo) (TokenInfo, error) {
+		info.Permissions = []string{"orders:read"}
+		return info, nil
+	}
+
+	login, err := tokens.Issue(ctx, TokenInfo{ActorID: 7}, testBinding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed, err := tokens.Refresh(ctx, login.RefreshToken, testBinding.DeviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.RefreshToken == login.RefreshToken || refreshed.AccessToken == "" {
+		t.Fatal("refresh did not rotate the token")
+	}
+	if !refreshed.ExpiresAt.Equal(login.ExpiresAt) {
+		t.Error("refresh extended the family lifetime")
+	}
+
+	old, current := store.row(t, login.RefreshToken), store.row(t, refreshed.RefreshToken)
+	if !old.rotated || current.rotated {
+		t.Error("the presented token was not marked rotated")
+	}
+	if old.family != current.family || current.session != testBinding.SessionID || current.device != testBinding.DeviceID {
+		t.Error("the rotated token left its family or binding")
+	}
+	var info TokenInfo
+	if err := json.Unmarshal(current.info, &info); err != nil || info.ActorID != 7 || len(info.Permissions) != 1 {
+		t.Errorf("refreshed claims %+v, %v", info, err)
+	}
+
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+refreshed.AccessToken)
+	if claims, err := tokens.jwt.GetTokenInfo(r); err != nil || len(claims.Permissions) != 1 || claims.Permissions[0] != "orders:read" {
+		t.Errorf("access token claims %+v, %v", claims, err)
+	}
+}
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	tokens, store := newTestRefreshTokens()
+	ctx := context.Background()
+
+	login, err := tokens.Issue(ctx, TokenInfo{ActorID: 7}, testBinding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshed, err := tokens.Refresh(ctx, login.RefreshToken, testBinding.DeviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := tokens.Issue(ctx, TokenInfo{ActorID: 7}, RefreshBinding{SessionID: "session-2", DeviceID: "device-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tokens.Refresh(ctx, login.RefreshToken, testBinding.DeviceID); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reuse returned %v, want ErrRefreshTokenReused", err)
+	}
+	if !store.row(t, refreshed.RefreshToken).revoked {
+		t.Error("reuse did not revoke the family")
+	}
+	if _, err := tokens.Refresh(ctx, refreshed.RefreshToken, testBinding.DeviceID); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("revoked family refreshed, %v", err)
+	}
+	if store.row(t, other.RefreshToken).revoked {
+		t.Error("reuse revoked another family")
+	}
+}
+
+func TestRefreshRejections(t *testing.T) {
+	tokens, store := newTestRefreshTokens()
+	ctx := context.Background()
+
+	if _, err := tokens.Refresh(ctx, "unknown", testBinding.DeviceID); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("unknown token returned %v", err)
+	}
+
+	// a token presented from another device is treated as stolen
+	stolen, err := tokens.Issue(ctx, TokenInfo{ActorID: 7}, testBinding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Refresh(ctx, stolen.RefreshToken, "device-2"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("other device returned %v", err)
+	}
+	if !store.row(t, stolen.RefreshToken).revoked {
+		t.Error("other device did not revoke the family")
+	}
+
+	// an expired token is rejected without revoking its family
+	expired, err := tokens.Issue(ctx, TokenInfo{ActorID: 7}, testBinding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.mu.Lock()
+	store.rows[hashRefreshToken(expired.RefreshToken)].expires = time.Now().Add(-time.Minute)
+	store.mu.Unlock()
+	if _, err := tokens.Refresh(ctx, expired.RefreshToken, testBinding.DeviceID); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("expired token returned %v", err)
+	}
+	if store.row(t, expired.RefreshToken).revoked {
+		t.Error("expiry revoked the family")
+	}
+
+	// logout revokes the family
+	if err := tokens.Revoke(ctx, expired.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if !store.row(t, expired.RefreshToken).revoked {
+		t.Error("Revoke did not revoke the family")
+	}
+}
@@ -1,8 +1,10 @@
 package server
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
@@ -10,17 +12,26 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/greatfocus/gf-sframe/crypt"
 	"github.com/greatfocus/gf-sframe/database"
 	"github.com/greatfocus/gf-sframe/logger"
 	"github.com/joho/godotenv"
 	"github.com/patrickmn/go-cache"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
 )
 
 // NewServer get new instance of server
@@ -36,6 +47,13 @@ func NewServer(serviceName, URI string) *Server {
 
 	// init creates instance of logger
 	logger := logger.NewLogger(serviceName)
+	if env == "dev" {
+		initDevPKI(logger)
+	}
+
+	Resolver = initIPResolver()
+	Limiter = initThrottle()
+	Roles = initRBAC(logger)
 
 	timeout, err := strconv.ParseUint(os.Getenv("SERVER_TIMEOUT"), 0, 64)
 	if err != nil {
@@ -43,15 +61,18 @@ func NewServer(serviceName, URI string) *Server {
 	}
 
 	srv := Server{
-		Name:     serviceName,
-		URI:      URI,
-		Env:      env,
-		Logger:   logger,
-		Cache:    initCache(),
-		JWT:      initJWT(),
-		Database: initDatabase(logger),
-		Timeout:  timeout,
-	}
+		Name:      serviceName,
+		URI:       URI,
+		Env:       env,
+		Logger:    logger,
+		Cache:     initCache(),
+		JWT:       initJWT(logger),
+		Database:  initDatabase(logger),
+		Timeout:   timeout,
+		TLSConfig: initTLS(logger),
+	}
+	initPermissions(&srv)
+	initGRPC(&srv)
 	return &srv
 }
 
@@ -69,6 +90,13 @@ type Server struct {
 	ServerPublicKey  *rsa.PublicKey
 	serverPrivateKey *rsa.PrivateKey
 	Timeout          uint64
+	TLSConfig        *tls.Config
+	GRPC             *grpc.Server
+	grpcHealth       *health.Server
+	grpcPublic       map[string]bool
+	// Sessions are validated on the routes set up by the server, websockets
+	// and gRPC calls, when set before Start
+	Sessions *Sessions
 }
 
 // Start the server
@@ -77,9 +105,25 @@ func (s *Server) Start() {
 
 	setUploadPath(s.Mux, s.URI)
 
+	setTusPath(s.Mux, s.URI, s.Logger, IsAuthenticated(s.JWT, s.sessions()...))
+
 	serverProbe(s.Mux, s.URI)
 
-	start(s.Mux, s.Logger, int(s.Timeout))
+	serverMetrics(s.Mux, s.URI)
+
+	if keys, ok := s.JWT.(interface{ Keyring() *Keyring }); ok {
+		s.Mux.Handle(JWKSPath, keys.Keyring())
+	}
+
+	start(s)
+}
+
+// sessions returns the Sessions to validate, as the variadic parameter of IsAuthenticated
+func (s *Server) sessions() []*Sessions {
+	if s.Sessions == nil {
+		return nil
+	}
+	return []*Sessions{s.Sessions}
 }
 
 func pki(s *Server) {
@@ -91,6 +135,9 @@ func pki(s *Server) {
 		clientPublicKeyString, err := base64.StdEncoding.DecodeString(clientPublicKey)
 		if err == nil {
 			publicBlock, _ := pem.Decode([]byte(clientPublicKeyString))
+			if publicBlock == nil {
+				return
+			}
 			pubKey, err := x509.ParsePKIXPublicKey(publicBlock.Bytes)
 			if err == nil {
 				s.clientPublicKey = pubKey.(*rsa.PublicKey)
@@ -106,6 +153,13 @@ func serverProbe(mux *http.ServeMux, uri string) {
 	mux.Handle(probeLoc, probe)
 }
 
+// serverMetrics serves the metrics variables, such as the concurrency limiter
+// state, to the addresses of METRICS_ALLOWED_IPS
+func serverMetrics(mux *http.ServeMux, uri string) {
+	metricsLoc := "/" + uri + "/debug/vars"
+	mux.Handle(metricsLoc, Use(metricsHandler(), IsAllowedIPs(os.Getenv("METRICS_ALLOWED_IPS"))))
+}
+
 func initCache() *cache.Cache {
 	// Create a cache with a default expiration time of 5 minutes, and which
 	// purges expired items every 10 minutes
@@ -122,19 +176,117 @@ func initCache() *cache.Cache {
 	return cache.New(time.Duration(expireVal), time.Duration(intervalVal))
 }
 
-func initJWT() JWT {
+func initJWT(logger *logrus.Logger) JWT {
 	minutes, err := strconv.ParseInt(os.Getenv("JWT_Minutes"), 0, 64)
 	if err != nil {
 		log.Fatal(fmt.Println(err))
 	}
 
-	authorized, err := strconv.ParseBool(os.Getenv("JWT_Authorized"))
+	if url := os.Getenv("JWT_JWKS_URL"); url != "" {
+		mapping := DefaultClaimMapping
+		if claim := os.Getenv("JWT_SUBJECT_CLAIM"); claim != "" {
+			mapping.Subject = claim
+		}
+		if claim := os.Getenv("JWT_ROLES_CLAIM"); claim != "" {
+			mapping.Roles = claim
+		}
+		if claim := os.Getenv("JWT_SCOPES_CLAIM"); claim != "" {
+			mapping.Scopes = claim
+		}
+		remote, err := NewRemoteJWT(RemoteJWTConfig{
+			URL:      url,
+			Issuer:   os.Getenv("JWT_ISSUER"),
+			Audience: os.Getenv("JWT_AUDIENCE"),
+			Claims:   mapping,
+			Logger:   logger,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return remote
+	}
+
+	// registered claims of issued tokens, checked when verifying
+	config := JWTConfig{
+		Issuer:   os.Getenv("JWT_ISSUER"),
+		Lifetime: time.Duration(minutes) * time.Minute,
+		Leeway:   time.Minute,
+	}
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		config.Audience = splitList(audience)
+	}
+
+	algorithm := os.Getenv("JWT_ALGORITHM")
+	if algorithm == "" || algorithm == "HS256" {
+		config.Secret = os.Getenv("JWT_Secret")
+		return mustJWT(config)
+	}
+
+	// retired keys verify tokens for their whole lifetime and the leeway
+	keyring, err := NewKeyring(algorithm, time.Duration(minutes)*time.Minute+config.Leeway)
 	if err != nil {
-		log.Fatal(fmt.Println(err))
+		log.Fatal(err)
+	}
+	var rotation time.Duration
+	if val := os.Getenv("JWT_ROTATION_INTERVAL"); val != "" {
+		interval, err := strconv.ParseInt(val, 0, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if interval <= 0 {
+			log.Fatal("JWT_ROTATION_INTERVAL must be positive")
+		}
+		rotation = time.Duration(interval) * time.Minute
 	}
 
-	secret := os.Getenv("JWT_Secret")
-	return NewJWT(secret, minutes, authorized)
+	content, err := readPEM("JWT_SIGNING_KEY")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if content == nil {
+		// generated keys differ per replica, tokens of one would fail on the
+		// others, so they are only generated in development
+		if os.Getenv("ENV") != "dev" {
+			log.Fatal("JWT_SIGNING_KEY is required for " + algorithm)
+		}
+		logger.Info("Generating " + algorithm + " signing key")
+		if err := keyring.Rotate(); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		if previous, err := readPEM("JWT_SIGNING_KEY_PREVIOUS"); err != nil {
+			log.Fatal(err)
+		} else if previous != nil {
+			key, err := ParseSigningKey(previous)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := keyring.Retire(key); err != nil {
+				log.Fatal(err)
+			}
+		}
+		key, err := ParseSigningKey(content)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := keyring.Add(key); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if rotation > 0 {
+		go keyring.RotateEvery(rotation, logger)
+	}
+	config.Keyring = keyring
+	return mustJWT(config)
+}
+
+// mustJWT creates the TokenInfo JWT, exiting on invalid configuration
+func mustJWT(config JWTConfig) JWT {
+	jwt, err := NewTypedJWT[TokenInfo](config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return jwt
 }
 
 func initDatabase(logger *logrus.Logger) database.Database {
@@ -143,11 +295,6 @@ func initDatabase(logger *logrus.Logger) database.Database {
 	databaseName := os.Getenv("DB_NAME")
 	user := os.Getenv("DB_USER")
 	password := os.Getenv("DB_PASSWORD")
-	sslmode := "disable"
-	var sslkeyPath, sslcertPath, sslcaPath string
-
-	// prepare ssl connection files
-	sslkeyPath, sslcertPath, sslcaPath = getDatabaseCertificate()
 
 	port, err := strconv.ParseUint(os.Getenv("DB_PORT"), 0, 64)
 	if err != nil {
@@ -170,26 +317,20 @@ func initDatabase(logger *logrus.Logger) database.Database {
 		log.Fatal(fmt.Println(err))
 	}
 
-	var psqlInfo string
-	if sslkeyPath != "" && sslcertPath != "" && sslcaPath == "" {
-		sslmode = "verify-full"
-		psqlInfo = fmt.Sprintf(
-			"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s sslrootcert=%s sslkey=%s sslcert=%s",
-			host, port, user, password, databaseName, sslmode, sslcaPath, sslkeyPath, sslcertPath)
-	} else if sslkeyPath == "" && sslcertPath == "" && sslcaPath != "" {
-		sslmode = "verify-ca"
-		psqlInfo = fmt.Sprintf(
-			"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s sslrootcert=%s",
-			host, port, user, password, databaseName, sslmode, sslcaPath)
-	} else {
-		psqlInfo = fmt.Sprintf(
-			"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
-			host, port, user, password, databaseName, sslmode)
+	// ssl material is kept in memory and never written to disk
+	tlsConfig, err := databaseTLSConfig(host)
+	if err != nil {
+		log.Fatal(fmt.Println(err))
 	}
 
+	psqlInfo := fmt.Sprintf(
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		host, port, user, password, databaseName)
+
 	// create database connection
 	params := database.DatabaseParam{
 		ConnectionStr: psqlInfo,
+		TLSConfig:     tlsConfig,
 		DatabaseName:  databaseName,
 		MaxLifetime:   maxLifetime,
 		MaxOpenConns:  int(maxOpenConns),
@@ -205,29 +346,145 @@ func setUploadPath(mux *http.ServeMux, uri string) {
 	if path == "" {
 		path = "./data/upload"
 	}
-	fs := http.FileServer(http.Dir(path))
+	var fs http.Handler = http.FileServer(http.Dir(path))
+	if key := os.Getenv("STORAGE_KEY"); key != "" {
+		fs = encryptedFileServer{dir: path, key: key}
+	}
 	fileLoc := "/" + uri + "/resource"
 	mux.Handle(fileLoc+"/", http.StripPrefix(fileLoc, fs))
 }
 
+// encryptedFileServer serves files stored encrypted at rest
+type encryptedFileServer struct {
+	dir string
+	key string
+}
+
+// ServeHTTP decrypts the requested file, range requests are supported
+func (e encryptedFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Add("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := filepath.Join(e.dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+	file, err := os.Open(name)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	stat, err := file.Stat()
+	if err != nil || stat.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// files stored before STORAGE_KEY was set are served as they are
+	if !crypt.IsEncrypted(file) {
+		http.ServeContent(w, r, stat.Name(), stat.ModTime(), file)
+		return
+	}
+	content, err := crypt.NewDecryptReader(file, e.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), content)
+}
+
 // start creates server instance
-func start(mux *http.ServeMux, logger *logrus.Logger, timeout int) {
+func start(s *Server) {
 	addr := ":" + os.Getenv("SERVER_PORT")
+	var handler http.Handler = s.Mux
+	grpcAddr := ""
+	if s.GRPC != nil {
+		grpcAddr = ":" + os.Getenv("GRPC_PORT")
+		if grpcAddr == ":" || grpcAddr == addr {
+			// share the http port, plaintext HTTP/2 is needed for gRPC without TLS
+			grpcAddr = ""
+			handler = grpcHandler(s.GRPC, s.Mux)
+			if s.TLSConfig == nil {
+				handler = h2c.NewHandler(handler, &http2.Server{})
+			}
+		}
+	}
+
 	srv := &http.Server{
 		Addr:           addr,
-		ReadTimeout:    time.Duration(timeout) * time.Second,
-		WriteTimeout:   time.Duration(timeout) * time.Second,
+		ReadTimeout:    time.Duration(s.Timeout) * time.Second,
+		WriteTimeout:   time.Duration(s.Timeout) * time.Second,
 		MaxHeaderBytes: 1 << 20,
-		Handler:        mux,
+		Handler:        handler,
+		TLSConfig:      s.TLSConfig,
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		s.Logger.Info("Listening to port HTTP" + addr)
+		if s.TLSConfig != nil {
+			// certificates are served by the TLS config
+			errs <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		errs <- srv.ListenAndServe()
+	}()
+
+	if grpcAddr != "" {
+		go func() {
+			s.Logger.Info("Listening to port gRPC" + grpcAddr)
+			lis, err := net.Listen("tcp", grpcAddr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- s.GRPC.Serve(lis)
+		}()
 	}
+	if s.grpcHealth != nil {
+		s.grpcHealth.Resume()
+	}
+
+	// both transports stop together, on a signal or when either fails
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	var err error
+	select {
+	case sig := <-stop:
+		s.Logger.Info("Shutting down on " + sig.String())
+	case err = <-errs:
+		s.Logger.Error(err)
+	}
+	shutdown(s, srv)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
 
-	// Get key certificate
-	logger.Info("Listening to port HTTP" + addr)
-	crt, key := GetServerCertificate()
-	if crt != "" && key != "" {
-		log.Fatal(srv.ListenAndServeTLS(crt, key))
+// shutdown gracefully stops the http and grpc servers
+func shutdown(s *Server, srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.Timeout)*time.Second)
+	defer cancel()
+
+	if s.GRPC != nil {
+		s.grpcHealth.Shutdown()
+		done := make(chan struct{})
+		go func() {
+			s.GRPC.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			s.GRPC.Stop()
+		}
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		s.Logger.Error(err)
 	}
-	log.Fatal(srv.ListenAndServe())
 }
 
 // Success returns object as json
@@ -322,46 +579,36 @@ func (s *Server) response(w http.ResponseWriter, r *http.Request, data interface
 
 }
 
-// Connect method make a database connection
-func getDatabaseCertificate() (cert, key, root string) {
-	sslrootcert := os.Getenv("DB_ROOT_CA")
-	sslkey := os.Getenv("DB_SSL_KEY")
-	sslcert := os.Getenv("DB_SSL_CERT")
-	if sslrootcert != "" {
-		root = CreateSSLCert("postgresql-ca.crt", os.Getenv("DB_ROOT_CA"))
-	}
-	if sslkey != "" {
-		key = CreateSSLCert("postgresql-client.key", os.Getenv("DB_SSL_KEY"))
-	}
-	if sslcert != "" {
-		cert = CreateSSLCert("postgresql-client.crt", os.Getenv("DB_SSL_CERT"))
-	}
-	return key, cert, root
-}
-
 // CreateSSLCert makes cert in image
+//
+// Deprecated: certificates are loaded in memory with GetServerCertificate,
+// writing key material to disk should be avoided.
 func CreateSSLCert(filename string, content string) string {
 	var path = os.Getenv("APP_PATH") + "/ssl/" + filename
 	path = filepath.Clean(path)
-	_, err := os.Open(path)
-	if errors.Is(err, os.ErrNotExist) {
-		file, err := os.Create(path)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer func() {
-			_ = file.Close()
-		}()
-		err = os.Chmod(path, 0600)
-		if err != nil {
-			log.Fatal(err)
-		}
 
-		cnt, err := base64.StdEncoding.DecodeString(content)
-		if err != nil {
-			file.WriteString(content)
-		}
-		file.WriteString(string(cnt))
+	cnt, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		cnt = []byte(content)
+	}
+
+	// write a private temporary file and swap it in, so readers never see
+	// partial content and rotated secrets replace the previous file
+	file, err := os.CreateTemp(filepath.Dir(path), filename+".*")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		_ = os.Remove(file.Name())
+	}()
+	if _, err := file.Write(cnt); err != nil {
+		log.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		log.Fatal(err)
 	}
 
 	return path
@@ -407,19 +654,23 @@ func serverEncrypt(payload string, publicKey *rsa.PublicKey) (string, error) {
 	return base64.StdEncoding.EncodeToString(encrypted), nil
 }
 
-// GetServerCertificate returns private and public key
-func GetServerCertificate() (string, string) {
-	var sslcert = os.Getenv("API_SSL_CERT")
-	var sslkey = os.Getenv("API_SSL_KEY")
-
-	// prepare ssl connection files
-	if sslkey != "" && sslcert != "" {
-		crt := CreateSSLCert("api-server.crt", sslcert)
-		key := CreateSSLCert("api-server.key", sslkey)
-		return crt, key
+// GetServerCertificate returns the server certificate from API_SSL_CERT and
+// API_SSL_KEY, or from the files named by API_SSL_CERT_FILE and API_SSL_KEY_FILE.
+// A nil certificate is returned when none is configured.
+func GetServerCertificate() (*tls.Certificate, error) {
+	source := serverCertificateSource()
+	if source == nil {
+		return nil, nil
 	}
-
-	return "", ""
+	certPEM, keyPEM, err := source()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
 }
 
 // GetServerPKI returns public key infrustructure
@@ -430,6 +681,9 @@ func GetServerPKI() (*rsa.PrivateKey, *rsa.PublicKey) {
 		return nil, nil
 	}
 	privateBlock, _ := pem.Decode([]byte(privateKeyString))
+	if privateBlock == nil {
+		return nil, nil
+	}
 	privKey, err := x509.ParsePKCS1PrivateKey(privateBlock.Bytes)
 	if err != nil {
 		return nil, nil
@@ -441,6 +695,9 @@ func GetServerPKI() (*rsa.PrivateKey, *rsa.PublicKey) {
 		return nil, nil
 	}
 	publicBlock, _ := pem.Decode([]byte(publicKeyString))
+	if publicBlock == nil {
+		return nil, nil
+	}
 	pubKey, err := x509.ParsePKIXPublicKey(publicBlock.Bytes)
 	if err != nil {
 		return nil, nil
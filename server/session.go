@@ -0,0 +1,445 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/greatfocus/gf-sframe/database"
+	"github.com/patrickmn/go-cache"
+)
+
+// SessionSchema creates the table of the postgres session store
+const SessionSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT PRIMARY KEY,
+	actor_id BIGINT NOT NULL,
+	device_id TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	ip TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL,
+	last_seen TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_actor ON sessions (actor_id);
+CREATE INDEX IF NOT EXISTS sessions_expires ON sessions (expires_at);`
+
+// SessionCookie is the cookie carrying the session id of browser clients
+const SessionCookie = "sid"
+
+var (
+	// ErrSessionNotFound is returned for unknown or revoked sessions
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrSessionExpired is returned for sessions past their idle or absolute timeout
+	ErrSessionExpired = errors.New("session expired")
+	// ErrNoAbsoluteTimeout is returned when creating sessions without an
+	// absolute timeout
+	ErrNoAbsoluteTimeout = errors.New("sessions need an absolute timeout")
+)
+
+// Session is a login of an actor on a device
+type Session struct {
+	ID        string    `json:"id"`
+	ActorID   int64     `json:"actorId"`
+	DeviceID  string    `json:"deviceId,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// SessionStore persists sessions
+type SessionStore interface {
+	Create(ctx context.Context, session *Session) error
+	Get(ctx context.Context, id string) (*Session, error)
+	Touch(ctx context.Context, id string, lastSeen time.Time) error
+	Delete(ctx context.Context, id string) error
+	List(ctx context.Context, actorID int64) ([]Session, error)
+}
+
+// Sessions creates and validates sessions with idle and absolute timeouts.
+// Validations are cached for CheckInterval, so a revocation on another
+// replica takes effect within it.
+type Sessions struct {
+	store SessionStore
+	// IdleTimeout ends sessions unused for this long
+	IdleTimeout time.Duration
+	// AbsoluteTimeout ends sessions this long after the login
+	AbsoluteTimeout time.Duration
+	// CheckInterval is how long a validation is cached
+	CheckInterval time.Duration
+	// OnRevoke is called for each revoked session, such as to revoke its
+	// refresh tokens
+	OnRevoke func(ctx context.Context, sessionID string)
+	checked  *cache.Cache
+}
+
+// NewSessions creates sessions kept in store, absoluteTimeout must be positive
+func NewSessions(store SessionStore, idleTimeout, absoluteTimeout time.Duration) *Sessions {
+	return &Sessions{
+		store:           store,
+		IdleTimeout:     idleTimeout,
+		AbsoluteTimeout: absoluteTimeout,
+		CheckInterval:   30 * time.Second,
+		checked:         cache.New(30*time.Second, time.Minute),
+	}
+}
+
+// Create starts a session for the actor of the login request
+func (s *Sessions) Create(ctx context.Context, actorID int64, r *http.Request) (*Session, error) {
+	if s.AbsoluteTimeout <= 0 {
+		return nil, ErrNoAbsoluteTimeout
+	}
+	now := time.Now()
+	session := &Session{
+		ID:        randomHex(32),
+		ActorID:   actorID,
+		DeviceID:  r.Header.Get(DeviceIDHeader),
+		UserAgent: r.UserAgent(),
+		IP:        ip(r),
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(s.AbsoluteTimeout),
+	}
+	if err := s.store.Create(ctx, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Validate checks that the session is active and belongs to the actor of
+// the token, recording its use
+func (s *Sessions) Validate(ctx context.Context, token *TokenInfo, id string) error {
+	actorID, err := s.check(ctx, id)
+	if err != nil {
+		return err
+	}
+	if token == nil || token.ActorID != actorID {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// sessionCheck is a cached validation
+type sessionCheck struct {
+	actorID int64
+	err     error
+}
+
+// check validates the session, returning its actor
+func (s *Sessions) check(ctx context.Context, id string) (int64, error) {
+	if id == "" {
+		return 0, ErrSessionNotFound
+	}
+	if value, found := s.checked.Get(id); found {
+		checked := value.(sessionCheck)
+		return checked.actorID, checked.err
+	}
+
+	actorID, err := s.validate(ctx, id)
+	if err == nil || errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionExpired) {
+		// store failures are not cached
+		s.checked.Set(id, sessionCheck{actorID: actorID, err: err}, s.CheckInterval)
+	}
+	return actorID, err
+}
+
+func (s *Sessions) validate(ctx context.Context, id string) (int64, error) {
+	session, err := s.store.Get(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	if now.After(session.ExpiresAt) || (s.IdleTimeout > 0 && now.Sub(session.LastSeen) > s.IdleTimeout) {
+		_ = s.Revoke(ctx, id)
+		return 0, ErrSessionExpired
+	}
+	return session.ActorID, s.store.Touch(ctx, id, now)
+}
+
+// Get returns an active session
+func (s *Sessions) Get(ctx context.Context, id string) (*Session, error) {
+	if _, err := s.check(ctx, id); err != nil {
+		return nil, err
+	}
+	return s.store.Get(ctx, id)
+}
+
+// List returns the sessions of an actor
+func (s *Sessions) List(ctx context.Context, actorID int64) ([]Session, error) {
+	return s.store.List(ctx, actorID)
+}
+
+// Revoke ends a session, such as on logout
+func (s *Sessions) Revoke(ctx context.Context, id string) error {
+	s.checked.Set(id, sessionCheck{err: ErrSessionNotFound}, s.CheckInterval)
+	if err := s.store.Delete(ctx, id); err != nil {
+		return err
+	}
+	if s.OnRevoke != nil {
+		s.OnRevoke(ctx, id)
+	}
+	return nil
+}
+
+// RevokeAll ends every session of an actor
+func (s *Sessions) RevokeAll(ctx context.Context, actorID int64) error {
+	sessions, err := s.store.List(ctx, actorID)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if err := s.Revoke(ctx, session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetCookie sends the session id as a secure http only cookie
+func (s *Sessions) SetCookie(w http.ResponseWriter, session *Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    session.ID,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// SessionID returns the session of the request, from the sid claim of the
+// token, or from the session cookie for requests without a token
+func SessionID(r *http.Request, token *TokenInfo) string {
+	if token != nil && token.SessionID != "" {
+		return token.SessionID
+	}
+	if r.Header.Get("Authorization") != "" {
+		return ""
+	}
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// cookieToken authenticates browser clients sending only the session cookie,
+// as the actor of the session
+func (s *Sessions) cookieToken(ctx context.Context, r *http.Request) (*TokenInfo, error) {
+	id := SessionID(r, nil)
+	actorID, err := s.check(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenInfo{ActorID: actorID, SessionID: id}, nil
+}
+
+// SessionsHandler lists the sessions of the authenticated actor with GET and
+// revokes them with DELETE, one by the id param or all without it
+func (s *Server) SessionsHandler(sessions *Sessions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := TokenFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			list, err := sessions.List(r.Context(), token.ActorID)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				s.Error(w, r, err)
+				return
+			}
+			s.Success(w, r, list)
+		case http.MethodDelete:
+			var err error
+			if id := r.URL.Query().Get("id"); id != "" {
+				err = revokeOwnSession(r.Context(), sessions, token.ActorID, id)
+			} else {
+				err = sessions.RevokeAll(r.Context(), token.ActorID)
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				s.Error(w, r, err)
+				return
+			}
+			s.Success(w, r, struct{}{})
+		default:
+			w.Header().Add("Allow", "GET, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// revokeOwnSession revokes a session of the actor, sessions of others are not found
+func revokeOwnSession(ctx context.Context, sessions *Sessions, actorID int64, id string) error {
+	session, err := sessions.store.Get(ctx, id)
+	if err != nil || session.ActorID != actorID {
+		return ErrSessionNotFound
+	}
+	return sessions.Revoke(ctx, id)
+}
+
+// cacheSessionStore keeps sessions in the server cache, for single instances
+type cacheSessionStore struct {
+	cache *cache.Cache
+	mu    sync.Mutex
+}
+
+// NewCacheSessionStore keeps sessions in memory, they are lost on restart and
+// not shared between replicas
+func NewCacheSessionStore(c *cache.Cache) SessionStore {
+	return &cacheSessionStore{cache: c}
+}
+
+func (c *cacheSessionStore) Create(ctx context.Context, session *Session) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stored := *session
+	c.cache.Set("session:"+session.ID, &stored, time.Until(session.ExpiresAt))
+	key := actorSessionsKey(session.ActorID)
+	ids, _ := c.cache.Get(key)
+	list, _ := ids.([]string)
+	c.cache.Set(key, append(list, session.ID), cache.NoExpiration)
+	return nil
+}
+
+func (c *cacheSessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, found := c.cache.Get("session:" + id)
+	if !found {
+		return nil, ErrSessionNotFound
+	}
+	session := *value.(*Session)
+	return &session, nil
+}
+
+func (c *cacheSessionStore) Touch(ctx context.Context, id string, lastSeen time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, found := c.cache.Get("session:" + id)
+	if !found {
+		return ErrSessionNotFound
+	}
+	value.(*Session).LastSeen = lastSeen
+	return nil
+}
+
+func (c *cacheSessionStore) Delete(ctx context.Context, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cache.Delete("session:" + id)
+	return nil
+}
+
+func (c *cacheSessionStore) List(ctx context.Context, actorID int64) ([]Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := actorSessionsKey(actorID)
+	ids, _ := c.cache.Get(key)
+	list, _ := ids.([]string)
+	sessions := []Session{}
+	active := list[:0]
+	for _, id := range list {
+		if value, found := c.cache.Get("session:" + id); found {
+			sessions = append(sessions, *value.(*Session))
+			active = append(active, id)
+		}
+	}
+	c.cache.Set(key, active, cache.NoExpiration)
+	return sessions, nil
+}
+
+func actorSessionsKey(actorID int64) string {
+	return "sessions:" + strconv.FormatInt(actorID, 10)
+}
+
+// postgresSessionStore keeps sessions in the sessions table
+type postgresSessionStore struct {
+	db database.Database
+}
+
+// NewPostgresSessionStore keeps sessions in postgres, shared by replicas.
+// SessionSchema must have been applied to the database.
+func NewPostgresSessionStore(db database.Database) SessionStore {
+	return &postgresSessionStore{db: db}
+}
+
+func (p *postgresSessionStore) Create(ctx context.Context, session *Session) error {
+	_, ok := p.db.Insert(ctx, `
+		INSERT INTO sessions (id, actor_id, device_id, user_agent, ip, created_at, last_seen, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		session.ID, session.ActorID, session.DeviceID, session.UserAgent, session.IP,
+		session.CreatedAt, session.LastSeen, session.ExpiresAt)
+	if !ok {
+		return errors.New("storing session failed")
+	}
+	return nil
+}
+
+func (p *postgresSessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	session := &Session{}
+	found, err := scanRow(ctx, p.db, `
+		SELECT id, actor_id, device_id, user_agent, ip, created_at, last_seen, expires_at
+		FROM sessions WHERE id = $1`, []interface{}{id},
+		&session.ID, &session.ActorID, &session.DeviceID, &session.UserAgent, &session.IP,
+		&session.CreatedAt, &session.LastSeen, &session.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (p *postgresSessionStore) Touch(ctx context.Context, id string, lastSeen time.Time) error {
+	// RETURNING tells a missing session from a failed update
+	var touched string
+	found, err := scanRow(ctx, p.db, "UPDATE sessions SET last_seen = $2 WHERE id = $1 RETURNING id",
+		[]interface{}{id, lastSeen}, &touched)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (p *postgresSessionStore) Delete(ctx context.Context, id string) error {
+	rows, err := p.db.Query(ctx, "DELETE FROM sessions WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+func (p *postgresSessionStore) List(ctx context.Context, actorID int64) ([]Session, error) {
+	rows, err := p.db.Query(ctx, `
+		SELECT id, actor_id, device_id, user_agent, ip, created_at, last_seen, expires_at
+		FROM sessions WHERE actor_id = $1 AND expires_at > now() ORDER BY last_seen DESC`, actorID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		if err := rows.Scan(&session.ID, &session.ActorID, &session.DeviceID, &session.UserAgent, &session.IP,
+			&session.CreatedAt, &session.LastSeen, &session.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 signature of a request as
+	// keyId="..",ts=..,nonce="..",headers="..",sig=".."
+	SignatureHeader = "Signature"
+	// ContentDigestHeader carries the sha-256 digest of the body (RFC 9530)
+	ContentDigestHeader = "Content-Digest"
+)
+
+// DefaultSignedHeaders are signed when no headers are named
+var DefaultSignedHeaders = []string{"host", "content-type"}
+
+var (
+	// ErrInvalidSignature is returned for missing, malformed or wrong signatures
+	ErrInvalidSignature = errors.New("invalid request signature")
+	// ErrSignatureExpired is returned for signatures outside the allowed clock skew
+	ErrSignatureExpired = errors.New("request signature expired")
+	// ErrSignatureReplayed is returned for a nonce seen before
+	ErrSignatureReplayed = errors.New("request signature replayed")
+)
+
+// SecretSource returns the shared secret of a client
+type SecretSource func(ctx context.Context, keyID string) ([]byte, error)
+
+// StaticSecrets returns fixed secrets by key id
+func StaticSecrets(secrets map[string]string) SecretSource {
+	return func(_ context.Context, keyID string) ([]byte, error) {
+		secret, ok := secrets[keyID]
+		if !ok {
+			return nil, ErrInvalidSignature
+		}
+		return []byte(secret), nil
+	}
+}
+
+// SignRequest signs the method, path and query, the named headers, the body
+// digest, a timestamp and a random nonce of the request with the secret
+func SignRequest(r *http.Request, keyID string, secret []byte, headers ...string) error {
+	if len(headers) == 0 {
+		headers = DefaultSignedHeaders
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	r.Header.Set(ContentDigestHeader, contentDigest(body))
+
+	signature := requestSignature{
+		keyID:     keyID,
+		timestamp: time.Now().Unix(),
+		nonce:     randomHex(16),
+		headers:   lowerAll(headers),
+	}
+	signature.sig = signature.sign(r, secret)
+	r.Header.Set(SignatureHeader, signature.String())
+	return nil
+}
+
+// SignatureVerifier verifies signed requests against the secrets of their
+// clients. Nonces are kept in the request id store for twice MaxSkew, so a
+// signed request is accepted once. Verifiers built as literals keep nonces in
+// a store of their own, and zero fields take the defaults on first use.
+type SignatureVerifier struct {
+	Secrets SecretSource
+	// MaxSkew is the clock skew allowed between client and server, 5 minutes
+	// by default
+	MaxSkew time.Duration
+	// Required headers must be signed, next to the body digest
+	Required []string
+	// MaxBody bounds the body read for the digest, 10 MB by default
+	MaxBody int64
+	Logger  *logrus.Logger
+	cache   *cache.Cache
+	once    sync.Once
+}
+
+// NewSignatureVerifier verifies requests with the secrets, keeping nonces in
+// the request id store of the server
+func (s *Server) NewSignatureVerifier(secrets SecretSource) *SignatureVerifier {
+	return &SignatureVerifier{
+		Secrets:  secrets,
+		MaxSkew:  5 * time.Minute,
+		Required: []string{"host"},
+		MaxBody:  10 << 20,
+		Logger:   s.Logger,
+		cache:    s.Cache,
+	}
+}
+
+// init sets the defaults of verifiers built as literals
+func (v *SignatureVerifier) init() {
+	v.once.Do(func() {
+		if v.MaxSkew <= 0 {
+			v.MaxSkew = 5 * time.Minute
+		}
+		if v.MaxBody <= 0 {
+			v.MaxBody = 10 << 20
+		}
+		if v.Logger == nil {
+			v.Logger = logrus.StandardLogger()
+		}
+		if v.cache == nil {
+			v.cache = cache.New(2*v.MaxSkew, time.Minute)
+		}
+	})
+}
+
+// Verify checks the signature of the request, returning the key id of the client
+func (v *SignatureVerifier) Verify(r *http.Request) (string, error) {
+	v.init()
+	signature, err := parseSignature(r.Header.Get(SignatureHeader))
+	if err != nil {
+		return "", err
+	}
+	for _, name := range v.Required {
+		if !containsFold(signature.headers, name) {
+			return signature.keyID, ErrInvalidSignature
+		}
+	}
+	skew := time.Since(time.Unix(signature.timestamp, 0))
+	if skew > v.MaxSkew || skew < -v.MaxSkew {
+		return signature.keyID, ErrSignatureExpired
+	}
+
+	if r.ContentLength > v.MaxBody {
+		return signature.keyID, ErrInvalidSignature
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, v.MaxBody+1))
+	if err != nil {
+		return signature.keyID, err
+	}
+	if int64(len(body)) > v.MaxBody {
+		return signature.keyID, ErrInvalidSignature
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if !hmac.Equal([]byte(r.Header.Get(ContentDigestHeader)), []byte(contentDigest(body))) {
+		return signature.keyID, ErrInvalidSignature
+	}
+
+	secret, err := v.Secrets(r.Context(), signature.keyID)
+	if err != nil {
+		return signature.keyID, ErrInvalidSignature
+	}
+	expected, _ := base64.StdEncoding.DecodeString(signature.sign(r, secret))
+	actual, err := base64.StdEncoding.DecodeString(signature.sig)
+	if err != nil || !hmac.Equal(expected, actual) {
+		return signature.keyID, ErrInvalidSignature
+	}
+
+	// the nonce is recorded once the signature is verified, so forged
+	// requests cannot burn the nonces of a client
+	nonce := "signature:" + signature.keyID + ":" + signature.nonce
+	if err := v.cache.Add(nonce, true, 2*v.MaxSkew); err != nil {
+		return signature.keyID, ErrSignatureReplayed
+	}
+	return signature.keyID, nil
+}
+
+// Middleware rejects requests without a valid signature, the key id of the
+// client is available to handlers with SignerFromContext
+func (v *SignatureVerifier) Middleware() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Verify sets the logger of literals
+			keyID, err := v.Verify(r)
+			if err != nil {
+				v.Logger.WithFields(logrus.Fields{
+					"keyId": keyID,
+					"ip":    ip(r),
+					"path":  r.URL.Path,
+				}).Warn("Request rejected, because of " + err.Error())
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			// continue
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), signerKey, keyID)))
+		})
+	}
+}
+
+const signerKey contextKey = "signer"
+
+// SignerFromContext returns the key id of the client that signed the request
+func SignerFromContext(ctx context.Context) (string, bool) {
+	keyID, ok := ctx.Value(signerKey).(string)
+	return keyID, ok
+}
+
+type requestSignature struct {
+	keyID     string
+	timestamp int64
+	nonce     string
+	headers   []string
+	sig       string
+}
+
+// sign returns the base64 HMAC-SHA256 of the canonical request
+func (s requestSignature) sign(r *http.Request, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = io.WriteString(mac, s.canonical(r))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// canonical is one line each for the method, the escaped path and query, the
+// key id, timestamp and nonce, the signed headers and the body digest
+func (s requestSignature) canonical(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method + "\n")
+	b.WriteString(r.URL.RequestURI() + "\n")
+	b.WriteString("keyid:" + s.keyID + "\n")
+	b.WriteString("ts:" + strconv.FormatInt(s.timestamp, 10) + "\n")
+	b.WriteString("nonce:" + s.nonce + "\n")
+	for _, name := range s.headers {
+		value := strings.Join(r.Header.Values(name), ", ")
+		if name == "host" {
+			value = r.Host
+			if value == "" {
+				value = r.URL.Host
+			}
+		}
+		b.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	b.WriteString("content-digest:" + r.Header.Get(ContentDigestHeader))
+	return b.String()
+}
+
+func (s requestSignature) String() string {
+	return `keyId="` + s.keyID + `",ts=` + strconv.FormatInt(s.timestamp, 10) +
+		`,nonce="` + s.nonce + `",headers="` + strings.Join(s.headers, " ") + `",sig="` + s.sig + `"`
+}
+
+func parseSignature(header string) (requestSignature, error) {
+	signature := requestSignature{}
+	for _, param := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			return signature, ErrInvalidSignature
+		}
+		value = strings.Trim(value, `"`)
+		switch name {
+		case "keyId":
+			signature.keyID = value
+		case "ts":
+			timestamp, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return signature, ErrInvalidSignature
+			}
+			signature.timestamp = timestamp
+		case "nonce":
+			signature.nonce = value
+		case "headers":
+			signature.headers = lowerAll(strings.Fields(value))
+		case "sig":
+			signature.sig = value
+		}
+	}
+	if signature.keyID == "" || signature.timestamp == 0 || !validRequestID(signature.nonce) || signature.sig == "" {
+		return signature, ErrInvalidSignature
+	}
+	return signature, nil
+}
+
+// readBody returns the body of a request to be sent, leaving it readable
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = body.Close()
+		}()
+		return io.ReadAll(body)
+	}
+	content, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(content))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+	return content, nil
+}
+
+func contentDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+func lowerAll(values []string) []string {
+	lower := make([]string, len(values))
+	for i, value := range values {
+		lower[i] = strings.ToLower(value)
+	}
+	return lower
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var testSecrets = StaticSecrets(map[string]string{"partner": "partner-secret"})
+
+func signedRequest(t *testing.T, method, target, body string, secret string) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if err := SignRequest(r, "partner", []byte(secret)); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func quietLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func TestSignatureVerify(t *testing.T) {
+	// a literal verifier takes the defaults and a nonce store of its own
+	verifier := &SignatureVerifier{Secrets: testSecrets, Required: []string{"host"}, Logger: quietLogger()}
+
+	r := signedRequest(t, http.MethodPost, "https://api.example.com/orders?id=1", `{"id":1}`, "partner-secret")
+	keyID, err := verifier.Verify(r)
+	if err != nil || keyID != "partner" {
+		t.Fatalf("Verify = %q, %v", keyID, err)
+	}
+	if body, _ := io.ReadAll(r.Body); string(body) != `{"id":1}` {
+		t.Errorf("body %q not readable after Verify", body)
+	}
+}
+
+func TestSignatureRejectsTampering(t *testing.T) {
+	verifier := &SignatureVerifier{Secrets: testSecrets, Required: []string{"host"}, MaxBody: 64}
+	tests := []struct {
+		name   string
+		tamper func(r *http.Request)
+		want   error
+	}{
+		{"method", func(r *http.Request) { r.Method = http.MethodDelete }, ErrInvalidSignature},
+		{"path", func(r *http.Request) { r.URL.Path = "/admin" }, ErrInvalidSignature},
+		{"query", func(r *http.Request) { r.URL.RawQuery = "id=2" }, ErrInvalidSignature},
+		{"host", func(r *http.Request) { r.Host = "evil.example.com" }, ErrInvalidSignature},
+		{"signed header", func(r *http.Request) { r.Header.Set("Content-Type", "text/plain") }, ErrInvalidSignature},
+		{"body", func(r *http.Request) { r.Body = io.NopCloser(strings.NewReader(`{"id":2}`)) }, ErrInvalidSignature},
+		{"oversized body", func(r *http.Request) {
+			r.Body = io.NopCloser(strings.NewReader(strings.Repeat("x", 100)))
+			r.ContentLength = -1
+		}, ErrInvalidSignature},
+		{"signature", func(r *http.Request) {
+			r.Header.Set(SignatureHeader, strings.Replace(r.Header.Get(SignatureHeader), `sig="`, `sig="A`, 1))
+		}, ErrInvalidSignature},
+		{"missing signature", func(r *http.Request) { r.Header.Del(SignatureHeader) }, ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		r := signedRequest(t, http.MethodPost, "https://api.example.com/orders?id=1", `{"id":1}`, "partner-secret")
+		tt.tamper(r)
+		if _, err := verifier.Verify(r); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	wrongSecret := signedRequest(t, http.MethodGet, "https://api.example.com/orders", "", "other-secret")
+	if _, err := verifier.Verify(wrongSecret); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("wrong secret: got %v", err)
+	}
+
+	unsignedHost := httptest.NewRequest(http.MethodGet, "https://api.example.com/orders", nil)
+	if err := SignRequest(unsignedHost, "partner", []byte("partner-secret"), "content-type"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(unsignedHost); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("required header not signed: got %v", err)
+	}
+}
+
+func TestSignatureExpired(t *testing.T) {
+	verifier := &SignatureVerifier{Secrets: testSecrets, MaxSkew: time.Minute}
+	for _, skew := range []time.Duration{-2 * time.Minute, 2 * time.Minute} {
+		r := httptest.NewRequest(http.MethodGet, "https://api.example.com/orders", nil)
+		r.Header.Set(ContentDigestHeader, contentDigest(nil))
+		signature := requestSignature{
+			keyID:     "partner",
+			timestamp: time.Now().Add(skew).Unix(),
+			nonce:     randomHex(16),
+			headers:   []string{"host"},
+		}
+		signature.sig = signature.sign(r, []byte("partner-secret"))
+		r.Header.Set(SignatureHeader, signature.String())
+		if _, err := verifier.Verify(r); !errors.Is(err, ErrSignatureExpired) {
+			t.Errorf("skew %s: got %v, want ErrSignatureExpired", skew, err)
+		}
+	}
+}
+
+func TestSignatureReplay(t *testing.T) {
+	// without a server cache the verifier keeps nonces itself
+	s := &Server{Logger: quietLogger()}
+	verifier := s.NewSignatureVerifier(testSecrets)
+
+	r := signedRequest(t, http.MethodPost, "https://api.example.com/orders", `{}`, "partner-secret")
+	replayed := r.Clone(r.Context())
+	replayed.Body = io.NopCloser(strings.NewReader(`{}`))
+
+	// a forged request reusing the nonce does not burn it
+	forged := r.Clone(r.Context())
+	forged.Body = io.NopCloser(strings.NewReader(`{"forged":true}`))
+	if _, err := verifier.Verify(forged); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("forged request: got %v", err)
+	}
+
+	if _, err := verifier.Verify(r); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if _, err := verifier.Verify(replayed); !errors.Is(err, ErrSignatureReplayed) {
+		t.Errorf("replayed request: got %v, want ErrSignatureReplayed", err)
+	}
+}
+
+func TestSignatureMiddleware(t *testing.T) {
+	verifier := &SignatureVerifier{Secrets: testSecrets, Logger: quietLogger()}
+	handler := Use(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keyID, _ := SignerFromContext(r.Context())
+		_, _ = io.WriteString(w, keyID)
+	}), verifier.Middleware())
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, signedRequest(t, http.MethodGet, "https://api.example.com/orders", "", "partner-secret"))
+	if w.Code != http.StatusOK || w.Body.String() != "partner" {
+		t.Errorf("signed request: %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://api.example.com/orders", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned request: %d", w.Code)
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sseHeartbeat is the interval of comment lines keeping idle streams open
+const sseHeartbeat = 15 * time.Second
+
+// Event is a server-sent event
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+// EventBuffer keeps recent events so clients can resume after reconnecting
+type EventBuffer interface {
+	// Add stores the event, assigning an ID when it has none
+	Add(event Event) Event
+	// Since returns the buffered events published after lastID
+	Since(lastID string) []Event
+}
+
+// eventBuffer is an in-memory ring of the latest events
+type eventBuffer struct {
+	mu     sync.RWMutex
+	events []Event
+	size   int
+	seq    uint64
+}
+
+// NewEventBuffer creates an in-memory buffer of the latest size events
+func NewEventBuffer(size int) EventBuffer {
+	return &eventBuffer{
+		events: make([]Event, 0, size),
+		size:   size,
+	}
+}
+
+// Add stores the event
+func (b *eventBuffer) Add(event Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	if event.ID == "" {
+		event.ID = strconv.FormatUint(b.seq, 10)
+	}
+	if len(b.events) == b.size {
+		b.events = append(b.events[:0], b.events[1:]...)
+	}
+	b.events = append(b.events, event)
+	return event
+}
+
+// Since returns the events after lastID, or every buffered event when
+// lastID is no longer known
+func (b *eventBuffer) Since(lastID string) []Event {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	start := 0
+	for i, event := range b.events {
+		if event.ID == lastID {
+			start = i + 1
+		}
+	}
+	return append([]Event(nil), b.events[start:]...)
+}
+
+// SSE streams events to the client until the channel is closed or the request
+// is cancelled. When a buffer is given, events missed since the Last-Event-ID
+// sent by a reconnecting client are replayed first.
+func (s *Server) SSE(w http.ResponseWriter, r *http.Request, events <-chan Event, buffer EventBuffer) error {
+	rc := http.NewResponseController(w)
+
+	// streams outlive the server write timeout and ProcessTimeout
+	markStreaming(r.Context())
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache, no-transform")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return err
+	}
+
+	replayed := make(map[string]bool)
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	if buffer != nil && lastID != "" {
+		for _, event := range buffer.Since(lastID) {
+			if err := writeEvent(w, rc, event); err != nil {
+				return err
+			}
+			replayed[event.ID] = true
+		}
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if replayed[event.ID] {
+				continue
+			}
+			if err := writeEvent(w, rc, event); err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return err
+			}
+			if err := rc.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeEvent writes the event in the text/event-stream format and flushes it
+func writeEvent(w http.ResponseWriter, rc *http.ResponseController, event Event) error {
+	var b strings.Builder
+	if event.ID != "" {
+		b.WriteString("id: " + stripNewlines(event.ID) + "\n")
+	}
+	if event.Event != "" {
+		b.WriteString("event: " + stripNewlines(event.Event) + "\n")
+	}
+	if event.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(event.Retry.Milliseconds(), 10) + "\n")
+	}
+	// \r\n, \r and \n all end a line of the data
+	data := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(event.Data)
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+
+	if _, err := w.Write([]byte(b.String())); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// stripNewlines prevents field values from injecting extra fields
+func stripNewlines(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
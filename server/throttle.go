@@ -1,44 +1,253 @@
 package server
 
 import (
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 
 	"golang.org/x/time/rate"
 )
 
+// Throttle limits requests per key, such as a client address or an actor
 type Throttle interface {
-	IsThrottled(ip string) bool
+	IsThrottled(key string) bool
+	Take(key string) RateLimitResult
+}
+
+// RateLimitResult describes the state of a key after taking a request
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// ThrottleConfig configures a keyed throttle. Rate is the number of requests
+// per second refilled for each key, up to Burst. GlobalRate and GlobalBurst cap
+// all keys together when set. Keys unused for IdleTimeout are evicted.
+type ThrottleConfig struct {
+	Rate        rate.Limit
+	Burst       int
+	GlobalRate  rate.Limit
+	GlobalBurst int
+	IdleTimeout time.Duration
+}
+
+// DefaultThrottleConfig allows a burst of 100 requests per key refilled at one
+// per second, and 6000 requests for the server
+var DefaultThrottleConfig = ThrottleConfig{
+	Rate:        1,
+	Burst:       100,
+	GlobalRate:  1,
+	GlobalBurst: 6000,
+	IdleTimeout: 10 * time.Minute,
 }
 
 // rateLimiter .
 type rateLimiter struct {
+	config   ThrottleConfig
 	requests *rate.Limiter
-	ip       map[string]*rate.Limiter
-	mu       *sync.RWMutex
+	keys     map[string]*keyLimiter
+	mu       *sync.Mutex
+	eviction sync.Once
+}
+
+type keyLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
 }
 
-// NewThrottle .
+// NewThrottle creates a throttle with the default configuration
 func NewThrottle() Throttle {
-	return &rateLimiter{
-		requests: rate.NewLimiter(rate.Every(1*time.Second), 6000),
-		ip:       make(map[string]*rate.Limiter),
-		mu:       &sync.RWMutex{},
+	return NewKeyedThrottle(DefaultThrottleConfig)
+}
+
+// NewKeyedThrottle creates a throttle with its own rate and burst, such as one
+// per route. Idle keys are evicted in the background once the throttle is used.
+func NewKeyedThrottle(config ThrottleConfig) Throttle {
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultThrottleConfig.IdleTimeout
+	}
+	t := &rateLimiter{
+		config: config,
+		keys:   make(map[string]*keyLimiter),
+		mu:     &sync.Mutex{},
 	}
+	if config.GlobalBurst > 0 {
+		t.requests = rate.NewLimiter(config.GlobalRate, config.GlobalBurst)
+	}
+	return t
 }
 
-func (i *rateLimiter) IsThrottled(ip string) bool {
-	defer i.mu.Unlock()
-	i.mu.Lock()
+// initThrottle configures the default throttle from THROTTLE_RATE,
+// THROTTLE_BURST, THROTTLE_GLOBAL_RATE and THROTTLE_GLOBAL_BURST
+func initThrottle() Throttle {
+	config := DefaultThrottleConfig
+	if val := os.Getenv("THROTTLE_RATE"); val != "" {
+		config.Rate = rate.Limit(parseFloatEnv(val))
+	}
+	if val := os.Getenv("THROTTLE_BURST"); val != "" {
+		config.Burst = int(parseFloatEnv(val))
+	}
+	if val := os.Getenv("THROTTLE_GLOBAL_RATE"); val != "" {
+		config.GlobalRate = rate.Limit(parseFloatEnv(val))
+	}
+	if val := os.Getenv("THROTTLE_GLOBAL_BURST"); val != "" {
+		config.GlobalBurst = int(parseFloatEnv(val))
+	}
+	return NewKeyedThrottle(config)
+}
+
+func parseFloatEnv(val string) float64 {
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
 
-	ipLimiter, exists := i.ip[ip]
+// IsThrottled takes a request for key and reports whether it was rejected
+func (i *rateLimiter) IsThrottled(key string) bool {
+	return !i.Take(key).Allowed
+}
+
+// Take takes a request for key from the key and global limits. A request
+// rejected by either limit consumes from neither.
+func (i *rateLimiter) Take(key string) RateLimitResult {
+	i.eviction.Do(func() {
+		go i.evict()
+	})
+	now := time.Now()
+
+	i.mu.Lock()
+	entry, exists := i.keys[key]
 	if !exists {
-		i.ip[ip] = rate.NewLimiter(rate.Every(1*time.Second), 100)
-		return false
+		entry = &keyLimiter{limiter: rate.NewLimiter(i.config.Rate, i.config.Burst)}
+		i.keys[key] = entry
+	}
+	entry.lastSeen = now
+	i.mu.Unlock()
+
+	result := RateLimitResult{Limit: i.config.Burst}
+	reservation := entry.limiter.ReserveN(now, 1)
+	retryAfter := reservationDelay(reservation, now)
+	if retryAfter == 0 && i.requests != nil {
+		global := i.requests.ReserveN(now, 1)
+		if retryAfter = reservationDelay(global, now); retryAfter > 0 {
+			global.CancelAt(now)
+		}
 	}
-	if !ipLimiter.Allow() {
-		return true
+	if retryAfter > 0 {
+		reservation.CancelAt(now)
 	}
 
-	return !i.requests.Allow()
+	tokens := entry.limiter.TokensAt(now)
+	result.Allowed = retryAfter == 0
+	result.RetryAfter = retryAfter
+	result.Remaining = int(math.Max(0, math.Floor(tokens)))
+	if i.config.Rate > 0 && !math.IsInf(float64(i.config.Rate), 1) {
+		missing := float64(i.config.Burst) - tokens
+		result.Reset = time.Duration(math.Max(0, missing) / float64(i.config.Rate) * float64(time.Second))
+	}
+	return result
+}
+
+// reservationDelay returns how long the reservation must wait, a reservation
+// that can never be satisfied waits for a second
+func reservationDelay(reservation *rate.Reservation, now time.Time) time.Duration {
+	if !reservation.OK() {
+		return time.Second
+	}
+	return reservation.DelayFrom(now)
+}
+
+// evict removes keys idle for longer than the idle timeout
+func (i *rateLimiter) evict() {
+	ticker := time.NewTicker(i.config.IdleTimeout / 2)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		i.mu.Lock()
+		for key, entry := range i.keys {
+			if now.Sub(entry.lastSeen) > i.config.IdleTimeout {
+				delete(i.keys, key)
+			}
+		}
+		i.mu.Unlock()
+	}
+}
+
+// KeyFunc extracts the rate limit key of a request, an empty key skips the limit
+type KeyFunc func(r *http.Request) string
+
+// ByIP keys requests by client address
+func ByIP(r *http.Request) string {
+	return ip(r)
+}
+
+// ByActor keys requests by the actor of the token, and by client address for
+// requests without a valid token
+func ByActor(jwt JWT) KeyFunc {
+	return func(r *http.Request) string {
+		token, err := jwt.GetTokenInfo(r)
+		if err != nil || token == nil {
+			return "ip:" + ip(r)
+		}
+		return "actor:" + strconv.FormatInt(token.ActorID, 10)
+	}
+}
+
+// ByHeader keys requests by a header and the client address, and by client
+// address alone for requests without it. The header is not verified, so use
+// it only for headers set by a trusted proxy or authenticated by an earlier
+// middleware. The address keeps a forged value from using up the limit of
+// the client it belongs to.
+func ByHeader(name string) KeyFunc {
+	return func(r *http.Request) string {
+		if value := r.Header.Get(name); value != "" {
+			return "header:" + value + ":ip:" + ip(r)
+		}
+		return "ip:" + ip(r)
+	}
+}
+
+// RateLimit limits requests by the key of each request and sets the
+// RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and Retry-After headers
+func RateLimit(throttle Throttle, key KeyFunc) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k := key(r)
+			if k == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			result := throttle.Take(k)
+			setRateLimitHeaders(w.Header(), result)
+			if !result.Allowed {
+				(w).WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+
+			// continue
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func setRateLimitHeaders(header http.Header, result RateLimitResult) {
+	header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	if !result.Allowed {
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
 }
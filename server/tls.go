@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// preferred TLS 1.2 cipher suites, TLS 1.3 suites are not configurable
+var tlsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+}
+
+var tlsCurves = []tls.CurveID{
+	tls.X25519,
+	tls.CurveP256,
+	tls.CurveP384,
+}
+
+// initTLS builds the server TLS configuration, nil when no certificate is configured
+func initTLS(logger *logrus.Logger) *tls.Config {
+	source := serverCertificateSource()
+	if source == nil {
+		return nil
+	}
+
+	interval := time.Minute
+	if val := os.Getenv("TLS_RELOAD_INTERVAL"); val != "" {
+		seconds, err := strconv.ParseInt(val, 0, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if seconds <= 0 {
+			log.Fatal("TLS_RELOAD_INTERVAL must be positive")
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+	reloader, err := newCertReloader(source, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go reloader.watch(interval)
+
+	cfg, err := NewTLSConfig(reloader.GetCertificate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cfg
+}
+
+// NewTLSConfig returns a hardened TLS configuration. Client certificates
+// verified against API_CLIENT_CA are requested when it is set, and required
+// unless API_CLIENT_AUTH is "optional".
+func NewTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*tls.Config, error) {
+	minVersion := uint16(tls.VersionTLS12)
+	if os.Getenv("TLS_MIN_VERSION") == "1.3" {
+		minVersion = tls.VersionTLS13
+	}
+
+	cfg := &tls.Config{
+		MinVersion:       minVersion,
+		CipherSuites:     tlsCipherSuites,
+		CurvePreferences: tlsCurves,
+		GetCertificate:   getCertificate,
+		NextProtos:       []string{"h2", "http/1.1"},
+	}
+
+	ca, err := readPEM("API_CLIENT_CA")
+	if err != nil {
+		return nil, err
+	}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("invalid client certificate authority")
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		if os.Getenv("API_CLIENT_AUTH") == "optional" {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return cfg, nil
+}
+
+// certSource returns the PEM encoded certificate and key
+type certSource func() (cert, key []byte, err error)
+
+// serverCertificateSource reads the server certificate from API_SSL_CERT_FILE
+// and API_SSL_KEY_FILE, or from the base64 API_SSL_CERT and API_SSL_KEY
+func serverCertificateSource() certSource {
+	if os.Getenv("API_SSL_CERT_FILE") == "" && os.Getenv("API_SSL_CERT") == "" {
+		return nil
+	}
+	return func() ([]byte, []byte, error) {
+		cert, err := readPEM("API_SSL_CERT")
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := readPEM("API_SSL_KEY")
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert, key, nil
+	}
+}
+
+// readPEM reads the file named by <name>_FILE, or decodes the base64 env value
+func readPEM(name string) ([]byte, error) {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		return os.ReadFile(path)
+	}
+	content := os.Getenv(name)
+	if content == "" {
+		return nil, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return []byte(content), nil
+	}
+	return decoded, nil
+}
+
+// certReloader serves the current certificate and swaps it when its source changes
+type certReloader struct {
+	source certSource
+	logger *logrus.Logger
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	sum    [sha256.Size]byte
+}
+
+// newCertReloader loads the initial certificate
+func newCertReloader(source certSource, logger *logrus.Logger) (*certReloader, error) {
+	c := &certReloader{
+		source: source,
+		logger: logger,
+	}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the current certificate for the handshake
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// reload parses the certificate when the source content changed
+func (c *certReloader) reload() (bool, error) {
+	certPEM, keyPEM, err := c.source()
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(bytes.Join([][]byte{certPEM, keyPEM}, nil))
+	c.mu.RLock()
+	unchanged := c.cert != nil && sum == c.sum
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.sum = sum
+	c.mu.Unlock()
+	return true, nil
+}
+
+// watch polls the certificate source
+func (c *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		changed, err := c.reload()
+		if err != nil {
+			// keep serving the previous certificate
+			c.logger.Error("Reloading server certificate failed, because of " + err.Error())
+			continue
+		}
+		if changed {
+			c.logger.Info("Server certificate reloaded")
+		}
+	}
+}
+
+// ClientIdentity is the identity presented by a verified client certificate
+type ClientIdentity struct {
+	CommonName   string
+	Organization []string
+	DNSNames     []string
+	URIs         []string
+	SerialNumber string
+	Fingerprint  string
+}
+
+const clientIdentityKey contextKey = "clientIdentity"
+
+// WithClientIdentity stores the identity of the verified client certificate in the request context
+func WithClientIdentity() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+				identity := newClientIdentity(r.TLS.VerifiedChains[0][0])
+				r = r.WithContext(context.WithValue(r.Context(), clientIdentityKey, identity))
+			}
+
+			// continue
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireClientIdentity rejects requests without a verified client certificate
+func RequireClientIdentity() Middleware {
+	return func(h http.Handler) http.Handler {
+		return WithClientIdentity()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := ClientIdentityFromContext(r.Context()); !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			// continue
+			h.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// ClientIdentityFromContext returns the client certificate identity of the request
+func ClientIdentityFromContext(ctx context.Context) (*ClientIdentity, bool) {
+	identity, ok := ctx.Value(clientIdentityKey).(*ClientIdentity)
+	return identity, ok
+}
+
+func newClientIdentity(cert *x509.Certificate) *ClientIdentity {
+	sum := sha256.Sum256(cert.Raw)
+	identity := &ClientIdentity{
+		CommonName:   cert.Subject.CommonName,
+		Organization: cert.Subject.Organization,
+		DNSNames:     cert.DNSNames,
+		SerialNumber: cert.SerialNumber.String(),
+		Fingerprint:  hex.EncodeToString(sum[:]),
+	}
+	for _, uri := range cert.URIs {
+		identity.URIs = append(identity.URIs, uri.String())
+	}
+	return identity
+}
+
+// databaseTLSConfig builds the postgres TLS configuration from DB_ROOT_CA,
+// DB_SSL_CERT and DB_SSL_KEY or their _FILE variants. The host name is
+// verified when a client certificate is given (verify-full), otherwise only
+// the chain is (verify-ca). Nil is returned when no material is configured.
+func databaseTLSConfig(host string) (*tls.Config, error) {
+	ca, err := readPEM("DB_ROOT_CA")
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := readPEM("DB_SSL_CERT")
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := readPEM("DB_SSL_KEY")
+	if err != nil {
+		return nil, err
+	}
+	if ca == nil && certPEM == nil && keyPEM == nil {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: host,
+	}
+	if ca != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("invalid database certificate authority")
+		}
+		cfg.RootCAs = pool
+	}
+	if certPEM != nil || keyPEM != nil {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+		return cfg, nil
+	}
+
+	// verify-ca checks the chain but not the host name
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("database presented no certificate")
+		}
+		opts := x509.VerifyOptions{
+			Roots:         cfg.RootCAs,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range state.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(opts)
+		return err
+	}
+	return cfg, nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// RequestIDHeader carries the request id between services
+const RequestIDHeader = "request-id"
+
+const (
+	requestIDKey contextKey = "requestID"
+	traceKey     contextKey = "trace"
+)
+
+// TraceContext is the W3C trace context of a request
+type TraceContext struct {
+	TraceID string
+	SpanID  string
+	Flags   string
+	State   string
+}
+
+// NewTraceContext starts a sampled trace
+func NewTraceContext() TraceContext {
+	return TraceContext{
+		TraceID: randomHex(16),
+		SpanID:  randomHex(8),
+		Flags:   "01",
+	}
+}
+
+// ParseTraceParent parses a traceparent header, later versions are read as
+// version 00
+func ParseTraceParent(value string) (TraceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || !isHex(parts[0], 2) || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return TraceContext{}, false
+	}
+	trace := TraceContext{TraceID: parts[1], SpanID: parts[2], Flags: parts[3]}
+	if !isHex(trace.TraceID, 32) || !isHex(trace.SpanID, 16) || !isHex(trace.Flags, 2) ||
+		strings.Trim(trace.TraceID, "0") == "" || strings.Trim(trace.SpanID, "0") == "" {
+		return TraceContext{}, false
+	}
+	return trace, true
+}
+
+// Child returns the context of an outgoing call, a new span of the same trace
+func (t TraceContext) Child() TraceContext {
+	t.SpanID = randomHex(8)
+	return t
+}
+
+// TraceParent formats the traceparent header
+func (t TraceContext) TraceParent() string {
+	return "00-" + t.TraceID + "-" + t.SpanID + "-" + t.Flags
+}
+
+// Propagate stores the request id and trace context of the request in its
+// context, generating them for requests without, and echoes the request id
+func Propagate() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get(RequestIDHeader)
+			if !validRequestID(requestID) {
+				requestID = randomHex(16)
+			}
+			trace, ok := ParseTraceParent(r.Header.Get("traceparent"))
+			if ok {
+				trace.State = r.Header.Get("tracestate")
+			} else {
+				trace = NewTraceContext()
+			}
+			w.Header().Set(RequestIDHeader, requestID)
+
+			ctx := WithTrace(WithRequestID(r.Context(), requestID), trace)
+
+			// continue
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// WithRequestID stores the request id in the context
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestIDFromContext returns the request id stored by Propagate
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// WithTrace stores the trace context in the context
+func WithTrace(ctx context.Context, trace TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey, trace)
+}
+
+// TraceFromContext returns the trace context stored by Propagate
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	trace, ok := ctx.Value(traceKey).(TraceContext)
+	return trace, ok
+}
+
+// validRequestID accepts short printable ids, so they are safe to log
+func validRequestID(value string) bool {
+	if value == "" || len(value) > 128 {
+		return false
+	}
+	for _, c := range value {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(value string, length int) bool {
+	if len(value) != length {
+		return false
+	}
+	for _, c := range value {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(size int) string {
+	buf := make([]byte, size)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,650 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/greatfocus/gf-sframe/crypt"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	tusResumable  = "1.0.0"
+	tusExtensions = "creation,creation-with-upload,termination,checksum,expiration"
+	tusChecksums  = "sha1,sha256,md5"
+	tusOffsetType = "application/offset+octet-stream"
+
+	// statusChecksumMismatch is the tus specific checksum failure status
+	statusChecksumMismatch = 460
+)
+
+var (
+	errUploadNotFound = errors.New("upload not found")
+	errUploadExpired  = errors.New("upload expired")
+)
+
+// uploadInfo is the persisted state of a resumable upload
+type uploadInfo struct {
+	ID       string            `json:"id"`
+	Size     int64             `json:"size"`
+	Offset   int64             `json:"offset"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Expires  time.Time         `json:"expires"`
+}
+
+// tusHandler implements the tus 1.0 resumable upload protocol
+type tusHandler struct {
+	base     string
+	dir      string
+	target   string
+	maxSize  int64
+	expiry   time.Duration
+	key      string
+	logger   *logrus.Logger
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+// defaultUploadMaxSize bounds uploads when UPLOAD_MAX_SIZE is not set
+const defaultUploadMaxSize = 1 << 30
+
+// setTusPath creates the resumable upload path when UPLOAD_TUS_PATH is set,
+// requests must pass auth
+func setTusPath(mux *http.ServeMux, uri string, logger *logrus.Logger, auth Middleware) {
+	dir := os.Getenv("UPLOAD_TUS_PATH")
+	if dir == "" {
+		return
+	}
+	target := os.Getenv("UPLOAD_PATH")
+	if target == "" {
+		target = "./data/upload"
+	}
+
+	var maxSize int64 = defaultUploadMaxSize
+	if val := os.Getenv("UPLOAD_MAX_SIZE"); val != "" {
+		size, err := strconv.ParseInt(val, 0, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if size <= 0 {
+			log.Fatal("UPLOAD_MAX_SIZE must be positive")
+		}
+		maxSize = size
+	}
+
+	expiry := 24 * time.Hour
+	if val := os.Getenv("UPLOAD_EXPIRE"); val != "" {
+		minutes, err := strconv.ParseInt(val, 0, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		expiry = time.Duration(minutes) * time.Minute
+	}
+
+	for _, p := range []string{dir, target} {
+		if err := os.MkdirAll(filepath.Clean(p), 0700); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	base := "/" + uri + "/upload/"
+	t := &tusHandler{
+		base:     base,
+		dir:      filepath.Clean(dir),
+		target:   filepath.Clean(target),
+		maxSize:  maxSize,
+		expiry:   expiry,
+		key:      os.Getenv("STORAGE_KEY"),
+		logger:   logger,
+		inFlight: make(map[string]bool),
+	}
+	go t.cleanup(expiry / 4)
+
+	mux.Handle(base, Use(t, auth))
+}
+
+// ServeHTTP dispatches tus requests
+func (t *tusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
+		method = override
+	}
+
+	w.Header().Set("Tus-Resumable", tusResumable)
+	if method == http.MethodOptions {
+		t.options(w)
+		return
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusResumable {
+		w.Header().Set("Tus-Version", tusResumable)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, t.base)
+	switch {
+	case method == http.MethodPost && id == "":
+		t.create(w, r)
+	case method == http.MethodHead && validUploadID(id):
+		t.head(w, id)
+	case method == http.MethodPatch && validUploadID(id):
+		t.patch(w, r, id)
+	case method == http.MethodDelete && validUploadID(id):
+		t.terminate(w, id)
+	case id == "" || validUploadID(id):
+		w.Header().Set("Allow", "OPTIONS, POST, HEAD, PATCH, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// options advertises the server capabilities
+func (t *tusHandler) options(w http.ResponseWriter) {
+	w.Header().Set("Tus-Version", tusResumable)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Checksum-Algorithm", tusChecksums)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(t.maxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// create registers a new upload
+func (t *tusHandler) create(w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if size > t.maxSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	info := &uploadInfo{
+		ID:       id,
+		Size:     size,
+		Metadata: metadata,
+		Expires:  time.Now().Add(t.expiry).UTC(),
+	}
+	file, err := os.OpenFile(t.dataPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		t.logger.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_ = file.Close()
+	if err := t.saveInfo(info); err != nil {
+		t.logger.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", t.base+id)
+	if size == 0 {
+		if err := t.complete(info); err != nil {
+			t.logger.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// creation-with-upload sends the first chunk along with the POST
+	if r.Header.Get("Content-Type") == tusOffsetType && r.ContentLength != 0 {
+		if !t.lock(id) {
+			w.WriteHeader(http.StatusLocked)
+			return
+		}
+		defer t.unlock(id)
+		if status := t.write(r, info); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	}
+
+	w.Header().Set("Upload-Expires", info.Expires.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// head returns the current offset of the upload
+func (t *tusHandler) head(w http.ResponseWriter, id string) {
+	w.Header().Set("Cache-Control", "no-store")
+	info, err := t.loadInfo(id)
+	if err != nil {
+		w.WriteHeader(uploadErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Size, 10))
+	if len(info.Metadata) > 0 {
+		w.Header().Set("Upload-Metadata", formatUploadMetadata(info.Metadata))
+	}
+	if info.Offset < info.Size {
+		w.Header().Set("Upload-Expires", info.Expires.Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// patch appends a chunk to the upload
+func (t *tusHandler) patch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != tusOffsetType {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !t.lock(id) {
+		w.WriteHeader(http.StatusLocked)
+		return
+	}
+	defer t.unlock(id)
+
+	info, err := t.loadInfo(id)
+	if err != nil {
+		w.WriteHeader(uploadErrorStatus(err))
+		return
+	}
+	// completed uploads were moved to the resource path
+	if info.Offset == info.Size {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	if offset != info.Offset {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if status := t.write(r, info); status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	if info.Offset < info.Size {
+		w.Header().Set("Upload-Expires", info.Expires.Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// terminate removes the upload and its data
+func (t *tusHandler) terminate(w http.ResponseWriter, id string) {
+	if !t.lock(id) {
+		w.WriteHeader(http.StatusLocked)
+		return
+	}
+	defer t.unlock(id)
+
+	if _, err := os.Stat(t.infoPath(id)); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	t.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// write appends the request body to the upload and returns a failure status or 0
+func (t *tusHandler) write(r *http.Request, info *uploadInfo) int {
+	var sum hash.Hash
+	var expected []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		var err error
+		sum, expected, err = parseUploadChecksum(header)
+		if err != nil {
+			return http.StatusBadRequest
+		}
+	}
+
+	remaining := info.Size - info.Offset
+	if r.ContentLength > remaining {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	file, err := os.OpenFile(t.dataPath(info.ID), os.O_RDWR, 0600)
+	if err != nil {
+		t.logger.Error(err)
+		return http.StatusInternalServerError
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	appender, err := t.openAppend(file, info.Offset)
+	if err != nil {
+		t.logger.Error(err)
+		return http.StatusInternalServerError
+	}
+
+	var dst io.Writer = appender
+	if sum != nil {
+		dst = io.MultiWriter(appender, sum)
+	}
+
+	// a broken connection still keeps the bytes received so far,
+	// unless the chunk is checksummed and cannot be verified
+	n, copyErr := io.Copy(dst, io.LimitReader(r.Body, remaining))
+	if sum != nil && (copyErr != nil || !bytes.Equal(sum.Sum(nil), expected)) {
+		if rollback, err := t.openAppend(file, info.Offset); err == nil {
+			_ = rollback.Close()
+		}
+		if copyErr != nil {
+			return http.StatusBadRequest
+		}
+		return statusChecksumMismatch
+	}
+	if err := appender.Close(); err != nil {
+		t.logger.Error(err)
+		return http.StatusInternalServerError
+	}
+	if err := file.Sync(); err != nil {
+		t.logger.Error(err)
+		return http.StatusInternalServerError
+	}
+
+	info.Offset += n
+	if err := t.saveInfo(info); err != nil {
+		t.logger.Error(err)
+		return http.StatusInternalServerError
+	}
+	if info.Offset == info.Size {
+		if err := t.complete(info); err != nil {
+			t.logger.Error(err)
+			return http.StatusInternalServerError
+		}
+	}
+	if copyErr != nil {
+		return http.StatusBadRequest
+	}
+	return 0
+}
+
+// complete moves a finished upload to the resource path, encrypting it
+// when STORAGE_KEY is set
+func (t *tusHandler) complete(info *uploadInfo) error {
+	target := filepath.Join(t.target, info.ID)
+	if t.key != "" {
+		if err := t.encrypt(info.ID, target); err != nil {
+			return err
+		}
+	} else if err := os.Rename(t.dataPath(info.ID), target); err != nil {
+		return err
+	}
+	t.logger.Info("Upload completed " + info.ID)
+	return nil
+}
+
+// encrypt seals the finished upload once into target, so no chunk of the
+// stream is ever sealed twice
+func (t *tusHandler) encrypt(id, target string) error {
+	in, err := os.Open(t.dataPath(id))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	tmp := t.dataPath(id) + ".enc"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		w, err := crypt.NewEncryptWriter(out, t.key)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, in); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return out.Sync()
+	}()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, target)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(t.dataPath(id))
+}
+
+// cleanup periodically removes expired uploads
+func (t *tusHandler) cleanup(interval time.Duration) {
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		entries, err := os.ReadDir(t.dir)
+		if err != nil {
+			t.logger.Error(err)
+			continue
+		}
+		for _, entry := range entries {
+			id, ok := strings.CutSuffix(entry.Name(), ".info")
+			if !ok || !t.lock(id) {
+				continue
+			}
+			// completed uploads only keep their state until expiry
+			info, err := t.loadInfo(id)
+			if errors.Is(err, errUploadExpired) || (err == nil && time.Now().After(info.Expires)) {
+				t.remove(id)
+				t.logger.Info("Upload expired " + id)
+			}
+			t.unlock(id)
+		}
+	}
+}
+
+// loadInfo reads the upload state and reconciles it with the data on disk
+func (t *tusHandler) loadInfo(id string) (*uploadInfo, error) {
+	content, err := os.ReadFile(t.infoPath(id))
+	if err != nil {
+		return nil, errUploadNotFound
+	}
+	info := &uploadInfo{}
+	if err := json.Unmarshal(content, info); err != nil {
+		return nil, err
+	}
+	if info.Offset < info.Size && time.Now().After(info.Expires) {
+		return info, errUploadExpired
+	}
+	return info, nil
+}
+
+// openAppend returns a writer continuing the upload at offset, bytes written
+// after the last persisted offset were never acknowledged and are discarded
+func (t *tusHandler) openAppend(file *os.File, offset int64) (io.WriteCloser, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &fileAppender{file: file, pos: offset}, nil
+}
+
+// saveInfo atomically persists the upload state
+func (t *tusHandler) saveInfo(info *uploadInfo) error {
+	content, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	tmp := t.infoPath(info.ID) + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.infoPath(info.ID))
+}
+
+// remove deletes the upload state and partial data
+func (t *tusHandler) remove(id string) {
+	_ = os.Remove(t.dataPath(id))
+	_ = os.Remove(t.infoPath(id))
+}
+
+// lock marks the upload as being modified
+func (t *tusHandler) lock(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inFlight[id] {
+		return false
+	}
+	t.inFlight[id] = true
+	return true
+}
+
+// unlock releases the upload
+func (t *tusHandler) unlock(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.inFlight, id)
+}
+
+// fileAppender writes uploads in place
+type fileAppender struct {
+	file *os.File
+	pos  int64
+}
+
+// Write appends to the upload
+func (f *fileAppender) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Close discards anything beyond the written position
+func (f *fileAppender) Close() error {
+	return f.file.Truncate(f.pos)
+}
+
+func (t *tusHandler) dataPath(id string) string {
+	return filepath.Join(t.dir, id+".part")
+}
+
+func (t *tusHandler) infoPath(id string) string {
+	return filepath.Join(t.dir, id+".info")
+}
+
+// uploadErrorStatus maps upload errors to http status
+func uploadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUploadNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errUploadExpired):
+		return http.StatusGone
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// newUploadID generates a random upload identifier
+func newUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// validUploadID guards against path traversal in upload urls
+func validUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		switch len(parts) {
+		case 1:
+			metadata[parts[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			metadata[parts[0]] = string(value)
+		default:
+			return nil, errors.New("invalid upload metadata")
+		}
+	}
+	return metadata, nil
+}
+
+// formatUploadMetadata encodes the Upload-Metadata header
+func formatUploadMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// parseUploadChecksum decodes the Upload-Checksum header
+func parseUploadChecksum(header string) (hash.Hash, []byte, error) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return nil, nil, errors.New("invalid upload checksum")
+	}
+	expected, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	switch parts[0] {
+	case "sha1":
+		return sha1.New(), expected, nil
+	case "sha256":
+		return sha256.New(), expected, nil
+	case "md5":
+		return md5.New(), expected, nil
+	}
+	return nil, nil, errors.New("unsupported checksum algorithm")
+}
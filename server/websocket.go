@@ -0,0 +1,295 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// time allowed to write a message to the peer
+	wsWriteWait = 10 * time.Second
+	// time allowed to read the next pong message from the peer
+	wsPongWait = 60 * time.Second
+	// send pings to peer with this period, must be less than wsPongWait
+	wsPingPeriod = (wsPongWait * 9) / 10
+)
+
+// WSHandler handles messages received on a websocket connection
+type WSHandler func(c *WSConn, msg []byte)
+
+// Hub keeps track of websocket connections by user and room
+type Hub struct {
+	// MessageRate is the number of messages per second a connection may send
+	MessageRate rate.Limit
+	// MessageBurst is the number of messages a connection may send at once
+	MessageBurst int
+	// SendBuffer is the number of outgoing messages queued per connection
+	// before the connection is considered too slow and dropped
+	SendBuffer int
+	// MaxMessageSize is the maximum size in bytes of an incoming message
+	MaxMessageSize int64
+
+	logger *logrus.Logger
+	mu     sync.RWMutex
+	users  map[int64]map[*WSConn]bool
+	rooms  map[string]map[*WSConn]bool
+}
+
+// NewHub creates a websocket hub
+func NewHub(logger *logrus.Logger) *Hub {
+	return &Hub{
+		MessageRate:    10,
+		MessageBurst:   20,
+		SendBuffer:     256,
+		MaxMessageSize: 64 * 1024,
+		logger:         logger,
+		users:          make(map[int64]map[*WSConn]bool),
+		rooms:          make(map[string]map[*WSConn]bool),
+	}
+}
+
+// SendToUser sends a message to every connection of the actor
+func (h *Hub) SendToUser(actorID int64, msg []byte) {
+	h.mu.RLock()
+	conns := make([]*WSConn, 0, len(h.users[actorID]))
+	for c := range h.users[actorID] {
+		conns = append(conns, c)
+	}
+	h.mu.RUnlock()
+
+	for _, c := range conns {
+		c.Send(msg)
+	}
+}
+
+// Broadcast sends a message to every connection in the room
+func (h *Hub) Broadcast(room string, msg []byte) {
+	h.mu.RLock()
+	conns := make([]*WSConn, 0, len(h.rooms[room]))
+	for c := range h.rooms[room] {
+		conns = append(conns, c)
+	}
+	h.mu.RUnlock()
+
+	for _, c := range conns {
+		c.Send(msg)
+	}
+}
+
+// Join adds the connection to a room
+func (h *Hub) Join(c *WSConn, room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c.closed {
+		return
+	}
+	if h.rooms[room] == nil {
+		h.rooms[room] = make(map[*WSConn]bool)
+	}
+	h.rooms[room][c] = true
+	c.rooms[room] = true
+}
+
+// Leave removes the connection from a room
+func (h *Hub) Leave(c *WSConn, room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.leave(c, room)
+}
+
+func (h *Hub) leave(c *WSConn, room string) {
+	delete(h.rooms[room], c)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+	delete(c.rooms, room)
+}
+
+// register adds a new connection for the token actor
+func (h *Hub) register(c *WSConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.users[c.Token.ActorID] == nil {
+		h.users[c.Token.ActorID] = make(map[*WSConn]bool)
+	}
+	h.users[c.Token.ActorID][c] = true
+}
+
+// unregister removes the connection from the hub and closes its queue
+func (h *Hub) unregister(c *WSConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	for room := range c.rooms {
+		h.leave(c, room)
+	}
+	delete(h.users[c.Token.ActorID], c)
+	if len(h.users[c.Token.ActorID]) == 0 {
+		delete(h.users, c.Token.ActorID)
+	}
+	close(c.send)
+}
+
+// WSConn is an authenticated websocket connection
+type WSConn struct {
+	Token   *TokenInfo
+	hub     *Hub
+	conn    *websocket.Conn
+	send    chan []byte
+	limiter *rate.Limiter
+	rooms   map[string]bool
+	closed  bool
+}
+
+// Send queues a message for the connection, a connection whose queue is full
+// is dropped rather than slowing down the sender
+func (c *WSConn) Send(msg []byte) bool {
+	c.hub.mu.RLock()
+	if c.closed {
+		c.hub.mu.RUnlock()
+		return false
+	}
+	select {
+	case c.send <- msg:
+		c.hub.mu.RUnlock()
+		return true
+	default:
+		c.hub.mu.RUnlock()
+	}
+
+	c.hub.logger.Warn("Dropping slow websocket connection")
+	c.hub.unregister(c)
+	return false
+}
+
+// Close terminates the connection
+func (c *WSConn) Close() {
+	c.hub.unregister(c)
+}
+
+// WebSocket returns a handler upgrading requests authenticated with the server JWT
+// and Sessions. The token is read from the Authorization header or the
+// access_token query parameter, since browsers cannot set headers on the handshake.
+func (s *Server) WebSocket(hub *Hub, allowedOrigin string, handler WSHandler) http.Handler {
+	origins := strings.Split(allowedOrigin, ",")
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			for _, v := range origins {
+				if v == "*" || v == origin {
+					return true
+				}
+			}
+			return false
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !websocket.IsWebSocketUpgrade(r) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		auth := r
+		if token := r.URL.Query().Get("access_token"); token != "" && r.Header.Get("Authorization") == "" {
+			auth = r.Clone(r.Context())
+			auth.Header.Set("Authorization", "Bearer "+token)
+		}
+		token, err := authenticate(auth, s.JWT, s.sessions()...)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// connections outlive the ProcessTimeout of requests
+		markStreaming(r.Context())
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader already replied with an error
+			return
+		}
+
+		c := &WSConn{
+			Token:   token,
+			hub:     hub,
+			conn:    conn,
+			send:    make(chan []byte, hub.SendBuffer),
+			limiter: rate.NewLimiter(hub.MessageRate, hub.MessageBurst),
+			rooms:   make(map[string]bool),
+		}
+		hub.register(c)
+
+		go c.writePump()
+		c.readPump(handler)
+	})
+}
+
+// readPump reads messages from the peer until the connection fails
+func (c *WSConn) readPump(handler WSHandler) {
+	defer func() {
+		c.hub.unregister(c)
+		_ = c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(c.hub.MaxMessageSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				c.hub.logger.Error(err)
+			}
+			return
+		}
+		if !c.limiter.Allow() {
+			_ = c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"),
+				time.Now().Add(wsWriteWait))
+			return
+		}
+		handler(c, msg)
+	}
+}
+
+// writePump writes queued messages and keepalive pings to the peer
+func (c *WSConn) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		_ = c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}